@@ -0,0 +1,509 @@
+package asm
+
+import (
+	"fmt"
+	"nesgo/cpu"
+	"strconv"
+	"strings"
+)
+
+// Program is the output of the assembler, Code is placed starting at Origin
+type Program struct {
+	Origin uint16
+	Code   []uint8
+}
+
+type operandSyntax uint8
+
+const (
+	syntaxNone operandSyntax = iota
+	syntaxAccumulator
+	syntaxImmediate
+	syntaxIndirectX
+	syntaxIndirectY
+	syntaxIndirect
+	syntaxIndexedX
+	syntaxIndexedY
+	syntaxDirect
+)
+
+type statement struct {
+	line      int
+	label     string
+	constant  string
+	mnemonic  string
+	operand   string
+	directive string
+	mode      cpu.AddressingMode
+}
+
+type assembler struct {
+	symbols    map[string]uint16
+	statements []*statement
+	pc         uint16
+	origin     uint16
+	started    bool
+	final      bool
+	code       []uint8
+}
+
+var official, unofficial = buildIndex()
+
+// Index the opcode table by mnemonic and addressing mode. Unofficial opcodes
+// are kept apart so an official encoding always wins when both exist
+func buildIndex() (map[string]map[cpu.AddressingMode]cpu.OpCode, map[string]map[cpu.AddressingMode]cpu.OpCode) {
+	off := map[string]map[cpu.AddressingMode]cpu.OpCode{}
+	unoff := map[string]map[cpu.AddressingMode]cpu.OpCode{}
+	for _, op := range cpu.OPTABLE {
+		table := off
+		name := op.Name()
+		if name[0] == '*' {
+			table = unoff
+			name = name[1:]
+		}
+		if table[name] == nil {
+			table[name] = map[cpu.AddressingMode]cpu.OpCode{}
+		}
+		// Several unofficial opcodes share a name and mode, pick the lowest
+		if prev, ok := table[name][op.Mode()]; !ok || op.Code() < prev.Code() {
+			table[name][op.Mode()] = op
+		}
+	}
+	return off, unoff
+}
+
+func lookup(mnemonic string, mode cpu.AddressingMode) (cpu.OpCode, bool) {
+	if strings.HasPrefix(mnemonic, "*") {
+		op, ok := unofficial[mnemonic[1:]][mode]
+		return op, ok
+	}
+	if op, ok := official[mnemonic][mode]; ok {
+		return op, true
+	}
+	op, ok := unofficial[mnemonic][mode]
+	return op, ok
+}
+
+func isMnemonic(mnemonic string) bool {
+	name := strings.TrimPrefix(mnemonic, "*")
+	return official[name] != nil || unofficial[name] != nil
+}
+
+// Assemble turns 6502 source into machine code. Code starts at
+// cpu.PROGRAM_START unless the source sets another origin with .org
+func Assemble(src string) (*Program, error) {
+	a := &assembler{symbols: map[string]uint16{}}
+	if err := a.parse(src); err != nil {
+		return nil, err
+	}
+	// The first pass settles label addresses, the second emits the code
+	if err := a.pass(); err != nil {
+		return nil, err
+	}
+	a.final = true
+	if err := a.pass(); err != nil {
+		return nil, err
+	}
+	return &Program{Origin: a.origin, Code: a.code}, nil
+}
+
+// MustAssemble is like Assemble but panics on error, it is meant for tests
+// and programs embedded in Go source
+func MustAssemble(src string) *Program {
+	p, err := Assemble(src)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func (a *assembler) parse(src string) error {
+	for i, raw := range strings.Split(src, "\n") {
+		st := &statement{line: i + 1}
+		text := stripComment(raw)
+		if idx := strings.Index(text, ":"); idx >= 0 && isIdentifier(strings.TrimSpace(text[:idx])) {
+			st.label = strings.TrimSpace(text[:idx])
+			text = text[idx+1:]
+		}
+		text = strings.TrimSpace(text)
+		if idx := strings.Index(text, "="); idx >= 0 && isIdentifier(strings.TrimSpace(text[:idx])) {
+			st.constant = strings.TrimSpace(text[:idx])
+			st.operand = strings.TrimSpace(text[idx+1:])
+			a.statements = append(a.statements, st)
+			continue
+		}
+		if text == "" {
+			if st.label != "" {
+				a.statements = append(a.statements, st)
+			}
+			continue
+		}
+		word, rest := text, ""
+		if idx := strings.IndexAny(text, " \t"); idx >= 0 {
+			word, rest = text[:idx], text[idx:]
+		}
+		word = strings.ToUpper(word)
+		st.operand = strings.TrimSpace(rest)
+		if strings.HasPrefix(word, ".") {
+			st.directive = word
+		} else if isMnemonic(word) {
+			st.mnemonic = word
+		} else {
+			return fmt.Errorf("line %d: unknown mnemonic %q", st.line, word)
+		}
+		a.statements = append(a.statements, st)
+	}
+	return nil
+}
+
+func stripComment(s string) string {
+	inString := false
+	for i, r := range s {
+		switch r {
+		case '"', '\'':
+			inString = !inString
+		case ';':
+			if !inString {
+				return s[:i]
+			}
+		}
+	}
+	return s
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		isLetter := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		isDigit := r >= '0' && r <= '9'
+		if !isLetter && !(i > 0 && isDigit) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *assembler) pass() error {
+	a.pc = cpu.PROGRAM_START
+	a.origin = cpu.PROGRAM_START
+	a.started = false
+	a.code = nil
+	for _, st := range a.statements {
+		if err := a.statement(st); err != nil {
+			return fmt.Errorf("line %d: %w", st.line, err)
+		}
+	}
+	return nil
+}
+
+func (a *assembler) statement(st *statement) error {
+	if st.label != "" {
+		if err := a.define(st.label, a.pc); err != nil {
+			return err
+		}
+	}
+	switch {
+	case st.constant != "":
+		v, known, err := a.eval(st.operand)
+		// Leave forward references undefined so their users pick the
+		// absolute form, as they will in the final pass
+		if err != nil || !known {
+			return err
+		}
+		return a.define(st.constant, uint16(v))
+	case st.directive != "":
+		return a.directive(st)
+	case st.mnemonic != "":
+		return a.instruction(st)
+	}
+	return nil
+}
+
+func (a *assembler) define(name string, v uint16) error {
+	if prev, ok := a.symbols[name]; ok && !a.final {
+		return fmt.Errorf("symbol %q already defined as $%04X", name, prev)
+	}
+	a.symbols[name] = v
+	return nil
+}
+
+func (a *assembler) emit(bytes ...uint8) {
+	if !a.started {
+		a.started = true
+		a.origin = a.pc
+	}
+	a.code = append(a.code, bytes...)
+	a.pc += uint16(len(bytes))
+}
+
+func (a *assembler) directive(st *statement) error {
+	switch st.directive {
+	case ".ORG":
+		v, _, err := a.eval(st.operand)
+		if err != nil {
+			return err
+		}
+		if !a.started {
+			a.pc = uint16(v)
+			return nil
+		}
+		if uint16(v) < a.pc {
+			return fmt.Errorf(".org $%04X is behind the current address $%04X", v, a.pc)
+		}
+		for a.pc < uint16(v) {
+			a.emit(0x00)
+		}
+	case ".BYTE", ".DB":
+		for _, arg := range splitArgs(st.operand) {
+			if strings.HasPrefix(arg, "\"") {
+				a.emit([]uint8(strings.Trim(arg, "\""))...)
+				continue
+			}
+			v, _, err := a.eval(arg)
+			if err != nil {
+				return err
+			}
+			if v > 0xFF || v < -0x80 {
+				return fmt.Errorf("byte value %d out of range", v)
+			}
+			a.emit(uint8(v))
+		}
+	case ".WORD", ".DW":
+		for _, arg := range splitArgs(st.operand) {
+			v, _, err := a.eval(arg)
+			if err != nil {
+				return err
+			}
+			a.emit(uint8(v), uint8(v>>8))
+		}
+	case ".SETCPU":
+		// Accepted so ca65 sources assemble, only the 6502 is supported
+		if !strings.EqualFold(strings.Trim(st.operand, "\""), "6502") {
+			return fmt.Errorf("unsupported cpu %s", st.operand)
+		}
+	default:
+		return fmt.Errorf("unknown directive %s", st.directive)
+	}
+	return nil
+}
+
+func splitArgs(s string) []string {
+	var args []string
+	inString := false
+	start := 0
+	for i, r := range s {
+		switch r {
+		case '"':
+			inString = !inString
+		case ',':
+			if !inString {
+				args = append(args, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(args, strings.TrimSpace(s[start:]))
+}
+
+func (a *assembler) instruction(st *statement) error {
+	syntax, expr := classify(st.operand)
+	// The ca65 a: prefix forces the absolute form of a zero page address
+	forceAbsolute := len(expr) > 2 && strings.EqualFold(expr[:2], "a:")
+	if forceAbsolute {
+		expr = expr[2:]
+	}
+	var v int
+	known := true
+	if expr != "" {
+		var err error
+		v, known, err = a.eval(expr)
+		if err != nil {
+			return err
+		}
+	}
+	if !a.final {
+		mode, err := chooseMode(st.mnemonic, syntax, v, known && !forceAbsolute)
+		if err != nil {
+			return err
+		}
+		st.mode = mode
+	}
+	op, _ := lookup(st.mnemonic, st.mode)
+	switch st.mode.Len() {
+	case 1:
+		a.emit(op.Code())
+	case 2:
+		if st.mode == cpu.RELATIVE {
+			offset := v - int(a.pc+2)
+			if a.final && (offset < -128 || offset > 127) {
+				return fmt.Errorf("branch target $%04X out of range", v)
+			}
+			a.emit(op.Code(), uint8(offset))
+			return nil
+		}
+		if a.final && (v > 0xFF || v < -0x80) {
+			return fmt.Errorf("operand $%X does not fit in a byte", v)
+		}
+		a.emit(op.Code(), uint8(v))
+	case 3:
+		a.emit(op.Code(), uint8(v), uint8(v>>8))
+	}
+	return nil
+}
+
+func classify(operand string) (operandSyntax, string) {
+	compact := removeSpaces(operand)
+	upper := strings.ToUpper(compact)
+	switch {
+	case upper == "":
+		return syntaxNone, ""
+	case upper == "A":
+		return syntaxAccumulator, ""
+	case strings.HasPrefix(upper, "#"):
+		return syntaxImmediate, compact[1:]
+	case strings.HasPrefix(upper, "(") && strings.HasSuffix(upper, ",X)"):
+		return syntaxIndirectX, compact[1 : len(compact)-3]
+	case strings.HasPrefix(upper, "(") && strings.HasSuffix(upper, "),Y"):
+		return syntaxIndirectY, compact[1 : len(compact)-3]
+	case strings.HasPrefix(upper, "(") && strings.HasSuffix(upper, ")"):
+		return syntaxIndirect, compact[1 : len(compact)-1]
+	case strings.HasSuffix(upper, ",X"):
+		return syntaxIndexedX, compact[:len(compact)-2]
+	case strings.HasSuffix(upper, ",Y"):
+		return syntaxIndexedY, compact[:len(compact)-2]
+	}
+	return syntaxDirect, compact
+}
+
+// removeSpaces drops the whitespace in an operand except inside character
+// literals, so ' ' stays a space
+func removeSpaces(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\'' && i+2 < len(s) && s[i+2] == '\'' {
+			sb.WriteString(s[i : i+3])
+			i += 2
+		} else if s[i] != ' ' && s[i] != '\t' {
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
+
+// chooseMode picks the addressing mode for an operand, preferring zero page
+// when the value is known and fits. Values that are not known yet are
+// forward references and get the absolute form
+func chooseMode(mnemonic string, syntax operandSyntax, v int, known bool) (cpu.AddressingMode, error) {
+	fitsZeroPage := known && v >= 0 && v <= 0xFF
+	var candidates []cpu.AddressingMode
+	switch syntax {
+	case syntaxNone:
+		candidates = []cpu.AddressingMode{cpu.IMPLIED, cpu.ACCUMULATOR}
+	case syntaxAccumulator:
+		candidates = []cpu.AddressingMode{cpu.ACCUMULATOR}
+	case syntaxImmediate:
+		candidates = []cpu.AddressingMode{cpu.IMMEDIATE}
+	case syntaxIndirectX:
+		candidates = []cpu.AddressingMode{cpu.INDIRECTX}
+	case syntaxIndirectY:
+		candidates = []cpu.AddressingMode{cpu.INDIRECTY}
+	case syntaxIndirect:
+		candidates = []cpu.AddressingMode{cpu.INDIRECT}
+	case syntaxIndexedX:
+		candidates = zeroPageFirst(fitsZeroPage, cpu.ZEROPAGEX, cpu.ABSOLUTEX)
+	case syntaxIndexedY:
+		candidates = zeroPageFirst(fitsZeroPage, cpu.ZEROPAGEY, cpu.ABSOLUTEY)
+	case syntaxDirect:
+		candidates = append([]cpu.AddressingMode{cpu.RELATIVE}, zeroPageFirst(fitsZeroPage, cpu.ZEROPAGE, cpu.ABSOLUTE)...)
+	}
+	for _, m := range candidates {
+		if _, ok := lookup(mnemonic, m); ok {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("%s does not support this addressing mode", mnemonic)
+}
+
+func zeroPageFirst(fits bool, zp, abs cpu.AddressingMode) []cpu.AddressingMode {
+	if fits {
+		return []cpu.AddressingMode{zp, abs}
+	}
+	return []cpu.AddressingMode{abs, zp}
+}
+
+// eval handles numbers ($hex, %binary, decimal, 'c'), symbols, * for the
+// current address, < and > for the low and high byte, unary minus, and + or
+// - between terms. known is false when a symbol is not defined yet in the
+// first pass
+func (a *assembler) eval(expr string) (int, bool, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return 0, false, fmt.Errorf("missing operand")
+	}
+	if expr[0] == '<' || expr[0] == '>' {
+		v, known, err := a.eval(expr[1:])
+		if expr[0] == '<' {
+			return v & 0xFF, known, err
+		}
+		return (v >> 8) & 0xFF, known, err
+	}
+	total := 0
+	known := true
+	sign := 1
+	start := 0
+	for i := 0; i <= len(expr); i++ {
+		// Character literals may be '+' or '-' themselves
+		if i < len(expr) && expr[i] == '\'' && i+2 < len(expr) && expr[i+2] == '\'' {
+			i += 2
+			continue
+		}
+		if i < len(expr) && !((expr[i] == '+' || expr[i] == '-') && i > start) {
+			continue
+		}
+		v, k, err := a.term(strings.TrimSpace(expr[start:i]))
+		if err != nil {
+			return 0, false, err
+		}
+		known = known && k
+		total += sign * v
+		if i < len(expr) && expr[i] == '-' {
+			sign = -1
+		} else {
+			sign = 1
+		}
+		start = i + 1
+	}
+	return total, known, nil
+}
+
+func (a *assembler) term(t string) (int, bool, error) {
+	switch {
+	case t == "*":
+		return int(a.pc), true, nil
+	case strings.HasPrefix(t, "-"):
+		v, known, err := a.term(strings.TrimSpace(t[1:]))
+		return -v, known, err
+	case strings.HasPrefix(t, "$"):
+		v, err := strconv.ParseUint(t[1:], 16, 16)
+		return int(v), true, err
+	case strings.HasPrefix(t, "%"):
+		v, err := strconv.ParseUint(t[1:], 2, 16)
+		return int(v), true, err
+	case len(t) == 3 && t[0] == '\'' && t[2] == '\'':
+		return int(t[1]), true, nil
+	case t != "" && t[0] >= '0' && t[0] <= '9':
+		v, err := strconv.ParseUint(t, 10, 16)
+		return int(v), true, err
+	case isIdentifier(t):
+		if v, ok := a.symbols[t]; ok {
+			return int(v), true, nil
+		}
+		if a.final {
+			return 0, false, fmt.Errorf("undefined symbol %q", t)
+		}
+		return 0, false, nil
+	}
+	return 0, false, fmt.Errorf("invalid expression %q", t)
+}
@@ -0,0 +1,222 @@
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"nesgo/cpu"
+	"testing"
+)
+
+func assert_code(t *testing.T, src string, expected []uint8) {
+	t.Helper()
+	p, err := Assemble(src)
+	if err != nil {
+		t.Fatalf("Assemble failed: %v", err)
+	}
+	if !bytes.Equal(p.Code, expected) {
+		t.Errorf("Wrong code for %q\nGot:      % X\nExpected: % X", src, p.Code, expected)
+	}
+}
+
+func TestAssemblesAddressingModes(t *testing.T) {
+	assert_code(t, "LDA #$F5", []uint8{0xA9, 0xF5})
+	assert_code(t, "LDA $F5", []uint8{0xA5, 0xF5})
+	assert_code(t, "LDA $33,X", []uint8{0xB5, 0x33})
+	assert_code(t, "LDX $33,Y", []uint8{0xB6, 0x33})
+	assert_code(t, "LDA $0647", []uint8{0xAD, 0x47, 0x06})
+	assert_code(t, "LDA $0300,X", []uint8{0xBD, 0x00, 0x03})
+	assert_code(t, "LDA $0300,Y", []uint8{0xB9, 0x00, 0x03})
+	assert_code(t, "LDA ($80,X)", []uint8{0xA1, 0x80})
+	assert_code(t, "LDA ($89),Y", []uint8{0xB1, 0x89})
+	assert_code(t, "JMP ($0200)", []uint8{0x6C, 0x00, 0x02})
+	assert_code(t, "ASL A", []uint8{0x0A})
+	assert_code(t, "ASL", []uint8{0x0A})
+	assert_code(t, "INX", []uint8{0xE8})
+}
+
+func TestAssemblesZeroPageYOnlyAsAbsolute(t *testing.T) {
+	// LDA has no zero page,Y form so the absolute form is used
+	assert_code(t, "LDA $10,Y", []uint8{0xB9, 0x10, 0x00})
+}
+
+func TestAssemblesUnofficialOpcodes(t *testing.T) {
+	assert_code(t, "LAX $10", []uint8{0xA7, 0x10})
+	assert_code(t, "*LAX ($10),Y", []uint8{0xB3, 0x10})
+	assert_code(t, "*SBC #$10", []uint8{0xEB, 0x10})
+	assert_code(t, "SBC #$10", []uint8{0xE9, 0x10})
+	assert_code(t, "*NOP", []uint8{0x1A})
+	assert_code(t, "NOP", []uint8{0xEA})
+	assert_code(t, "DCP $0300,X", []uint8{0xDF, 0x00, 0x03})
+}
+
+func TestAssemblesEveryOpcodeInTable(t *testing.T) {
+	operands := map[cpu.AddressingMode]string{
+		cpu.IMPLIED:     "",
+		cpu.ACCUMULATOR: "A",
+		cpu.IMMEDIATE:   "#$12",
+		cpu.ZEROPAGE:    "$12",
+		cpu.ZEROPAGEX:   "$12,X",
+		cpu.ZEROPAGEY:   "$12,Y",
+		cpu.RELATIVE:    "$8010",
+		cpu.ABSOLUTE:    "$1234",
+		cpu.ABSOLUTEX:   "$1234,X",
+		cpu.ABSOLUTEY:   "$1234,Y",
+		cpu.INDIRECTX:   "($12,X)",
+		cpu.INDIRECTY:   "($12),Y",
+		cpu.INDIRECT:    "($1234)",
+	}
+	for _, op := range cpu.OPTABLE {
+		src := fmt.Sprintf("%s %s", op.Name(), operands[op.Mode()])
+		p, err := Assemble(src)
+		if err != nil {
+			t.Errorf("Failed to assemble %q: %v", src, err)
+			continue
+		}
+		got := cpu.OPTABLE[p.Code[0]]
+		if got.Name() != op.Name() || got.Mode() != op.Mode() || len(p.Code) != int(op.Len()) {
+			t.Errorf("%q assembled to % X", src, p.Code)
+		}
+	}
+}
+
+func TestAssemblesLabelsAndBranches(t *testing.T) {
+	src := `
+		LDX #$08
+	loop:
+		DEX
+		BNE loop
+		JMP end
+	end:
+		BRK
+	`
+	assert_code(t, src, []uint8{0xA2, 0x08, 0xCA, 0xD0, 0xFD, 0x4C, 0x08, 0x80, 0x00})
+}
+
+func TestForwardReferenceUsesAbsolute(t *testing.T) {
+	src := `
+		LDA data
+		BRK
+	data = $10
+	`
+	assert_code(t, src, []uint8{0xAD, 0x10, 0x00, 0x00})
+}
+
+func TestAssemblesConstantsAndByteSelectors(t *testing.T) {
+	src := `
+	PPUCTRL = $2000
+		LDA #<target
+		LDX #>target
+		STA PPUCTRL
+	target:
+	`
+	assert_code(t, src, []uint8{0xA9, 0x07, 0xA2, 0x80, 0x8D, 0x00, 0x20})
+}
+
+func TestAssemblesSpaceCharacter(t *testing.T) {
+	assert_code(t, "LDA #' '\nCMP #'-'\nCPX # 'a' + 1", []uint8{0xA9, 0x20, 0xC9, 0x2D, 0xE0, 0x62})
+}
+
+func TestAssemblesNegativeValues(t *testing.T) {
+	src := `
+		.byte -1, -128
+		LDA #-2
+		LDX #5+-1
+	`
+	assert_code(t, src, []uint8{0xFF, 0x80, 0xA9, 0xFE, 0xA2, 0x04})
+}
+
+func TestAssemblesDirectives(t *testing.T) {
+	src := `
+		.org $C000
+	start:
+		.byte $01, 2, %11, 'A', "hi"
+		.word start, $1234
+	`
+	p, err := Assemble(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(p.Origin == 0xC000) {
+		t.Errorf("Wrong origin %04X", p.Origin)
+	}
+	expected := []uint8{0x01, 0x02, 0x03, 0x41, 0x68, 0x69, 0x00, 0xC0, 0x34, 0x12}
+	if !bytes.Equal(p.Code, expected) {
+		t.Errorf("Wrong code\nGot:      % X\nExpected: % X", p.Code, expected)
+	}
+}
+
+func TestAbsolutePrefixKeepsAbsoluteEncoding(t *testing.T) {
+	src := `
+		.setcpu "6502"
+		tmp = $10
+		LDA a:tmp
+		LDA a:$10,X
+		LDA tmp
+	`
+	assert_code(t, src, []uint8{0xAD, 0x10, 0x00, 0xBD, 0x10, 0x00, 0xA5, 0x10})
+}
+
+func TestOrgPadsForward(t *testing.T) {
+	src := `
+		.org $8000
+		NOP
+		.org $8004
+		NOP
+	`
+	assert_code(t, src, []uint8{0xEA, 0x00, 0x00, 0x00, 0xEA})
+}
+
+func TestAssembleErrors(t *testing.T) {
+	cases := []string{
+		"FOO $10",
+		"LDA",
+		"STA #$10",
+		"JMP missing",
+		"BNE far\n.org $9000\nfar:",
+		"a:\na:",
+		".org $9000\nNOP\n.org $8000",
+		".bogus 1",
+	}
+	for _, src := range cases {
+		if _, err := Assemble(src); err == nil {
+			t.Errorf("Expected error for %q", src)
+		}
+	}
+}
+
+type flatMemory struct {
+	data [0x10000]uint8
+}
+
+func (m *flatMemory) Read(addr uint16) uint8 {
+	return m.data[addr]
+}
+
+func (m *flatMemory) Write(addr uint16, v uint8) {
+	m.data[addr] = v
+}
+
+func (m *flatMemory) Tick(cycles uint8) {
+}
+
+func TestAssembledProgramRuns(t *testing.T) {
+	p := MustAssemble(`
+		LDX #$00
+		LDA #$00
+	loop:
+		CLC
+		ADC #$03
+		INX
+		CPX #$05
+		BNE loop
+		STA $10
+		BRK
+	`)
+	m := &flatMemory{}
+	copy(m.data[p.Origin:], p.Code)
+	c := cpu.NewCPU(m, cpu.RICOH_2A03)
+	c.Run()
+	if !(m.data[0x10] == 15) {
+		t.Errorf("Program computed %d, expected 15", m.data[0x10])
+	}
+}
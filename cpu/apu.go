@@ -0,0 +1,701 @@
+package cpu
+
+const APU_REGISTERS uint16 = 0x4000
+const APU_REGISTERS_END uint16 = 0x4013
+const APU_STATUS uint16 = 0x4015
+const APU_FRAME_COUNTER uint16 = 0x4017
+
+// Values loaded into the length counters, indexed by the top 5 bits of
+// $4003, $4007, $400B and $400F
+var LENGTH_TABLE = [32]uint8{
+	10, 254, 20, 2, 40, 4, 80, 6, 160, 8, 60, 10, 14, 12, 26, 14,
+	12, 16, 24, 18, 48, 20, 96, 22, 192, 24, 72, 26, 16, 28, 32, 30,
+}
+
+var DUTY_TABLE = [4][8]uint8{
+	{0, 1, 0, 0, 0, 0, 0, 0},
+	{0, 1, 1, 0, 0, 0, 0, 0},
+	{0, 1, 1, 1, 1, 0, 0, 0},
+	{1, 0, 0, 1, 1, 1, 1, 1},
+}
+
+var TRIANGLE_TABLE = [32]uint8{
+	15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0,
+	0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+// The DAC outputs are not linear, the mixer formulas are looked up instead
+// of computed every cycle
+var PULSE_MIX [31]float32
+var TND_MIX [203]float32
+
+func init() {
+	for i := 1; i < len(PULSE_MIX); i++ {
+		PULSE_MIX[i] = float32(95.52 / (8128.0/float64(i) + 100))
+	}
+	for i := 1; i < len(TND_MIX); i++ {
+		TND_MIX[i] = float32(163.67 / (24329.0/float64(i) + 100))
+	}
+}
+
+type envelope struct {
+	start    bool
+	loop     bool // shares its bit with the length counter halt
+	constant bool
+	volume   uint8 // constant volume and divider period
+	divider  uint8
+	decay    uint8
+}
+
+func (e *envelope) write(v uint8) {
+	e.loop = v&0b0010_0000 != 0
+	e.constant = v&0b0001_0000 != 0
+	e.volume = v & 0b0000_1111
+}
+
+func (e *envelope) clock() {
+	if e.start {
+		e.start = false
+		e.decay = 15
+		e.divider = e.volume
+		return
+	}
+	if e.divider > 0 {
+		e.divider--
+		return
+	}
+	e.divider = e.volume
+	if e.decay > 0 {
+		e.decay--
+	} else if e.loop {
+		e.decay = 15
+	}
+}
+
+func (e *envelope) output() uint8 {
+	if e.constant {
+		return e.volume
+	}
+	return e.decay
+}
+
+type lengthCounter struct {
+	enabled bool
+	halt    bool
+	value   uint8
+}
+
+// Loading is ignored while the channel is disabled through $4015
+func (l *lengthCounter) load(v uint8) {
+	if l.enabled {
+		l.value = LENGTH_TABLE[v>>3]
+	}
+}
+
+func (l *lengthCounter) setEnabled(on bool) {
+	l.enabled = on
+	if !on {
+		l.value = 0
+	}
+}
+
+func (l *lengthCounter) clock() {
+	if !l.halt && l.value > 0 {
+		l.value--
+	}
+}
+
+type pulse struct {
+	// Pulse 1 negates its sweep with ones' complement, so it subtracts one
+	// more than pulse 2
+	ones_complement bool
+	duty            uint8
+	step            uint8
+	period          uint16
+	timer           uint16
+	envelope        envelope
+	length          lengthCounter
+	sweep_enabled   bool
+	sweep_period    uint8
+	sweep_negate    bool
+	sweep_shift     uint8
+	sweep_divider   uint8
+	sweep_reload    bool
+}
+
+func (p *pulse) writeControl(v uint8) {
+	p.duty = v >> 6
+	p.length.halt = v&0b0010_0000 != 0
+	p.envelope.write(v)
+}
+
+func (p *pulse) writeSweep(v uint8) {
+	p.sweep_enabled = v&0b1000_0000 != 0
+	p.sweep_period = (v >> 4) & 0b111
+	p.sweep_negate = v&0b0000_1000 != 0
+	p.sweep_shift = v & 0b111
+	p.sweep_reload = true
+}
+
+func (p *pulse) writeTimerLow(v uint8) {
+	p.period = (p.period & 0x0700) | uint16(v)
+}
+
+// Writing the length also restarts the envelope and the duty cycle
+func (p *pulse) writeTimerHigh(v uint8) {
+	p.period = (p.period & 0x00FF) | uint16(v&0b111)<<8
+	p.length.load(v)
+	p.envelope.start = true
+	p.step = 0
+}
+
+// The timer counts APU cycles, every other CPU cycle
+func (p *pulse) clockTimer() {
+	if p.timer > 0 {
+		p.timer--
+		return
+	}
+	p.timer = p.period
+	p.step = (p.step + 1) % 8
+}
+
+func (p *pulse) sweepTarget() uint16 {
+	change := p.period >> p.sweep_shift
+	if !p.sweep_negate {
+		return p.period + change
+	}
+	if p.ones_complement {
+		change++
+	}
+	if change > p.period {
+		return 0
+	}
+	return p.period - change
+}
+
+// The sweep mutes the channel even while it is disabled
+func (p *pulse) muted() bool {
+	return p.period < 8 || p.sweepTarget() > 0x7FF
+}
+
+func (p *pulse) clockSweep() {
+	if p.sweep_divider == 0 && p.sweep_enabled && p.sweep_shift > 0 && !p.muted() {
+		p.period = p.sweepTarget()
+	}
+	if p.sweep_divider == 0 || p.sweep_reload {
+		p.sweep_divider = p.sweep_period
+		p.sweep_reload = false
+	} else {
+		p.sweep_divider--
+	}
+}
+
+func (p *pulse) output() uint8 {
+	if p.length.value == 0 || p.muted() || DUTY_TABLE[p.duty][p.step] == 0 {
+		return 0
+	}
+	return p.envelope.output()
+}
+
+type triangle struct {
+	period        uint16
+	timer         uint16
+	step          uint8
+	length        lengthCounter
+	linear        uint8
+	linear_period uint8
+	linear_reload bool
+}
+
+// The control bit halts the length counter and keeps the linear counter
+// reloading
+func (t *triangle) writeControl(v uint8) {
+	t.length.halt = v&0b1000_0000 != 0
+	t.linear_period = v & 0b0111_1111
+}
+
+func (t *triangle) writeTimerLow(v uint8) {
+	t.period = (t.period & 0x0700) | uint16(v)
+}
+
+func (t *triangle) writeTimerHigh(v uint8) {
+	t.period = (t.period & 0x00FF) | uint16(v&0b111)<<8
+	t.length.load(v)
+	t.linear_reload = true
+}
+
+// Unlike the other channels the triangle timer runs at the CPU clock
+func (t *triangle) clockTimer() {
+	if t.timer > 0 {
+		t.timer--
+		return
+	}
+	t.timer = t.period
+	if t.length.value > 0 && t.linear > 0 {
+		t.step = (t.step + 1) % 32
+	}
+}
+
+func (t *triangle) clockLinear() {
+	if t.linear_reload {
+		t.linear = t.linear_period
+	} else if t.linear > 0 {
+		t.linear--
+	}
+	if !t.length.halt {
+		t.linear_reload = false
+	}
+}
+
+// A silenced triangle holds its last step instead of dropping to 0
+func (t *triangle) output() uint8 {
+	return TRIANGLE_TABLE[t.step]
+}
+
+type noise struct {
+	periods  [16]uint16
+	period   uint16
+	timer    uint16
+	short    bool // mode flag, feedback from bit 6 instead of bit 1
+	shift    uint16
+	envelope envelope
+	length   lengthCounter
+}
+
+func (n *noise) writeControl(v uint8) {
+	n.length.halt = v&0b0010_0000 != 0
+	n.envelope.write(v)
+}
+
+func (n *noise) writePeriod(v uint8) {
+	n.short = v&0b1000_0000 != 0
+	n.period = n.periods[v&0b1111]
+}
+
+func (n *noise) writeLength(v uint8) {
+	n.length.load(v)
+	n.envelope.start = true
+}
+
+// The period table is in CPU cycles
+func (n *noise) clockTimer() {
+	if n.timer > 0 {
+		n.timer--
+		return
+	}
+	n.timer = n.period - 1
+	tap := uint16(1)
+	if n.short {
+		tap = 6
+	}
+	feedback := (n.shift ^ (n.shift >> tap)) & 1
+	n.shift = (n.shift >> 1) | feedback<<14
+}
+
+func (n *noise) output() uint8 {
+	if n.length.value == 0 || n.shift&1 == 1 {
+		return 0
+	}
+	return n.envelope.output()
+}
+
+// The DMC fetches its samples from $8000-$FFFF, the address wraps there
+const DMC_SAMPLE_BASE uint16 = 0xC000
+
+type dmc struct {
+	rates         [16]uint16
+	irq_enabled   bool
+	loop          bool
+	rate          uint16
+	timer         uint16
+	level         uint8
+	sample_addr   uint16
+	sample_length uint16
+	addr          uint16 // next byte the reader fetches
+	remaining     uint16 // bytes left in the sample
+	buffer        uint8
+	buffer_full   bool
+	shift         uint8
+	bits          uint8
+	silence       bool
+	irq           bool
+}
+
+// Clearing the IRQ enable bit also acknowledges the interrupt
+func (d *dmc) writeControl(v uint8) {
+	d.irq_enabled = v&0b1000_0000 != 0
+	d.loop = v&0b0100_0000 != 0
+	d.rate = d.rates[v&0b1111]
+	if !d.irq_enabled {
+		d.irq = false
+	}
+}
+
+func (d *dmc) writeLevel(v uint8) {
+	d.level = v & 0b0111_1111
+}
+
+func (d *dmc) writeAddress(v uint8) {
+	d.sample_addr = DMC_SAMPLE_BASE + uint16(v)*64
+}
+
+func (d *dmc) writeLength(v uint8) {
+	d.sample_length = uint16(v)*16 + 1
+}
+
+// Enabling only restarts the sample once the last one has finished
+func (d *dmc) setEnabled(on bool) {
+	if !on {
+		d.remaining = 0
+	} else if d.remaining == 0 {
+		d.restart()
+	}
+}
+
+func (d *dmc) restart() {
+	d.addr = d.sample_addr
+	d.remaining = d.sample_length
+}
+
+// needsSample asks the bus for a DMA fetch of the byte at addr
+func (d *dmc) needsSample() bool {
+	return !d.buffer_full && d.remaining > 0
+}
+
+func (d *dmc) loadSample(v uint8) {
+	d.buffer = v
+	d.buffer_full = true
+	d.addr++
+	if d.addr == 0 {
+		d.addr = 0x8000
+	}
+	d.remaining--
+	if d.remaining == 0 {
+		if d.loop {
+			d.restart()
+		} else if d.irq_enabled {
+			d.irq = true
+		}
+	}
+}
+
+// The rate table is in CPU cycles. Every tick moves the level by 2 in the
+// direction of the next sample bit, without wrapping
+func (d *dmc) clockTimer() {
+	if d.timer > 0 {
+		d.timer--
+		return
+	}
+	d.timer = d.rate - 1
+	if !d.silence {
+		if d.shift&1 == 1 {
+			if d.level <= 125 {
+				d.level += 2
+			}
+		} else if d.level >= 2 {
+			d.level -= 2
+		}
+	}
+	d.shift >>= 1
+	d.bits--
+	if d.bits == 0 {
+		d.bits = 8
+		d.silence = !d.buffer_full
+		d.shift = d.buffer
+		d.buffer_full = false
+	}
+}
+
+func (d *dmc) output() uint8 {
+	return d.level
+}
+
+type APU struct {
+	pulse1   pulse
+	pulse2   pulse
+	triangle triangle
+	noise    noise
+	dmc      dmc
+	timing   Timing
+	cycles   uint // CPU cycles, every second one clocks the pulse timers
+	frame    uint // CPU cycles into the frame counter sequence
+	// $4017, five step mode and the frame IRQ inhibit
+	five_step     bool
+	irq_inhibit   bool
+	frame_irq     bool
+	frame_control uint8
+	reset_pending bool  // $4017 was written during the cycles being ticked
+	reset_delay   uint8 // cycles until a $4017 write restarts the sequence
+	reset_control uint8 // the value that restart takes its mode from
+	out           float32
+	// Called with the mixer output every CPU cycle
+	sample_callback func(float32)
+}
+
+func NewAPU() *APU {
+	a := &APU{}
+	a.SetRegion(REGION_NTSC)
+	a.PowerOn()
+	return a
+}
+
+func (a *APU) SetRegion(r Region) {
+	a.timing = r.Timing()
+	a.noise.periods = a.timing.NoisePeriods
+	a.dmc.rates = a.timing.DMCRates
+}
+
+func (a *APU) SetSampleCallback(f func(float32)) {
+	a.sample_callback = f
+}
+
+// PowerOn silences every channel and clears all registers
+func (a *APU) PowerOn() {
+	periods := a.noise.periods
+	a.pulse1 = pulse{ones_complement: true}
+	a.pulse2 = pulse{}
+	a.triangle = triangle{}
+	a.noise = noise{periods: periods, period: periods[0], shift: 1}
+	rates := a.dmc.rates
+	a.dmc = dmc{rates: rates, rate: rates[0], bits: 8, silence: true}
+	a.dmc.writeAddress(0)
+	a.dmc.writeLength(0)
+	a.cycles = 0
+	a.frame = 0
+	a.frame_irq = false
+	a.out = 0
+	a.WriteToFrameCounter(0)
+	a.startFrameCounterReset()
+}
+
+// Reset acts like a write of 0 to $4015 and writes the last $4017 value
+// again, the channels keep their settings
+func (a *APU) SoftReset() {
+	a.WriteToStatus(0)
+	a.frame_irq = false
+	a.WriteToFrameCounter(a.frame_control)
+	a.startFrameCounterReset()
+}
+
+func (a *APU) WriteToRegister(addr uint16, v uint8) {
+	switch addr {
+	case 0x4000:
+		a.pulse1.writeControl(v)
+	case 0x4001:
+		a.pulse1.writeSweep(v)
+	case 0x4002:
+		a.pulse1.writeTimerLow(v)
+	case 0x4003:
+		a.pulse1.writeTimerHigh(v)
+	case 0x4004:
+		a.pulse2.writeControl(v)
+	case 0x4005:
+		a.pulse2.writeSweep(v)
+	case 0x4006:
+		a.pulse2.writeTimerLow(v)
+	case 0x4007:
+		a.pulse2.writeTimerHigh(v)
+	case 0x4008:
+		a.triangle.writeControl(v)
+	case 0x400A:
+		a.triangle.writeTimerLow(v)
+	case 0x400B:
+		a.triangle.writeTimerHigh(v)
+	case 0x400C:
+		a.noise.writeControl(v)
+	case 0x400E:
+		a.noise.writePeriod(v)
+	case 0x400F:
+		a.noise.writeLength(v)
+	case 0x4010:
+		a.dmc.writeControl(v)
+	case 0x4011:
+		a.dmc.writeLevel(v)
+	case 0x4012:
+		a.dmc.writeAddress(v)
+	case 0x4013:
+		a.dmc.writeLength(v)
+	case APU_STATUS:
+		a.WriteToStatus(v)
+	case APU_FRAME_COUNTER:
+		a.WriteToFrameCounter(v)
+	}
+}
+
+// WriteToStatus enables the channels, a disabled channel has its length
+// counter cleared. Any write acknowledges the DMC interrupt
+func (a *APU) WriteToStatus(v uint8) {
+	a.pulse1.length.setEnabled(v&0b0001 != 0)
+	a.pulse2.length.setEnabled(v&0b0010 != 0)
+	a.triangle.length.setEnabled(v&0b0100 != 0)
+	a.noise.length.setEnabled(v&0b1000 != 0)
+	a.dmc.setEnabled(v&0b1_0000 != 0)
+	a.dmc.irq = false
+}
+
+// ReadStatus reports which length counters are still running, whether the
+// DMC has bytes left and both interrupts. Bit 5 is not driven, the bus fills
+// it with open bus. Reading acknowledges the frame interrupt
+func (a *APU) ReadStatus() uint8 {
+	var ret uint8
+	if a.pulse1.length.value > 0 {
+		ret |= 0b0001
+	}
+	if a.pulse2.length.value > 0 {
+		ret |= 0b0010
+	}
+	if a.triangle.length.value > 0 {
+		ret |= 0b0100
+	}
+	if a.noise.length.value > 0 {
+		ret |= 0b1000
+	}
+	if a.dmc.remaining > 0 {
+		ret |= 0b0001_0000
+	}
+	if a.frame_irq {
+		ret |= 0b0100_0000
+	}
+	if a.dmc.irq {
+		ret |= 0b1000_0000
+	}
+	a.frame_irq = false
+	return ret
+}
+
+// WriteToFrameCounter picks the sequencer mode and restarts the sequence 3
+// or 4 cycles later, depending on where in the APU cycle the write lands.
+// Setting the inhibit flag acknowledges the frame interrupt
+func (a *APU) WriteToFrameCounter(v uint8) {
+	a.frame_control = v
+	a.irq_inhibit = v&0b0100_0000 != 0
+	if a.irq_inhibit {
+		a.frame_irq = false
+	}
+	a.reset_pending = true
+}
+
+// startFrameCounterReset runs once the cycles of the instruction that wrote
+// $4017 have been ticked, the write was on the last of them. The sequence
+// restarts 3 cycles after a write on an APU cycle and 4 after one between
+func (a *APU) startFrameCounterReset() {
+	if !a.reset_pending {
+		return
+	}
+	a.reset_pending = false
+	a.reset_control = a.frame_control
+	a.reset_delay = 3
+	if a.cycles%2 == 1 {
+		a.reset_delay = 4
+	}
+}
+
+// IRQ is the level the APU drives on the CPU's IRQ line
+func (a *APU) IRQ() bool {
+	return a.dmc.irq || a.frame_irq
+}
+
+// Output is the mixer level after the last cycle, between 0 and about 1
+func (a *APU) Output() float32 {
+	return a.out
+}
+
+// Tick runs the cycles of one CPU access like Bus.Tick, register writes
+// made before it happened on its last cycle
+func (a *APU) Tick(cycles uint8) {
+	for i := uint8(0); i < cycles; i++ {
+		a.tickCycle()
+	}
+	a.startFrameCounterReset()
+}
+
+func (a *APU) tickCycle() {
+	a.cycles++
+	a.triangle.clockTimer()
+	a.noise.clockTimer()
+	a.dmc.clockTimer()
+	if a.cycles%2 == 0 {
+		a.pulse1.clockTimer()
+		a.pulse2.clockTimer()
+	}
+	a.clockFrameCounter()
+	a.out = a.mix()
+	if a.sample_callback != nil {
+		a.sample_callback(a.out)
+	}
+}
+
+// The frame counter clocks envelopes and the linear counter four times a
+// sequence, lengths and sweeps on every second of those. The four step
+// sequence raises the frame interrupt over its last three cycles, the five
+// step one leaves its fourth step empty and never interrupts
+func (a *APU) clockFrameCounter() {
+	if a.reset_delay > 0 {
+		a.reset_delay--
+		if a.reset_delay == 0 {
+			a.frame = 0
+			a.five_step = a.reset_control&0b1000_0000 != 0
+			// Five step mode clocks everything right away
+			if a.five_step {
+				a.clockQuarterFrame()
+				a.clockHalfFrame()
+			}
+			return
+		}
+	}
+	a.frame++
+	steps := a.timing.FrameSteps
+	switch a.frame {
+	case steps[0], steps[2]:
+		a.clockQuarterFrame()
+	case steps[1]:
+		a.clockQuarterFrame()
+		a.clockHalfFrame()
+	case steps[3] - 1:
+		a.raiseFrameIRQ()
+	case steps[3]:
+		if !a.five_step {
+			a.clockQuarterFrame()
+			a.clockHalfFrame()
+			a.raiseFrameIRQ()
+		}
+	case steps[3] + 1:
+		if !a.five_step {
+			a.raiseFrameIRQ()
+			a.frame = 0
+		}
+	case steps[4]:
+		a.clockQuarterFrame()
+		a.clockHalfFrame()
+	case steps[4] + 1:
+		a.frame = 0
+	}
+}
+
+func (a *APU) raiseFrameIRQ() {
+	if !a.five_step && !a.irq_inhibit {
+		a.frame_irq = true
+	}
+}
+
+func (a *APU) clockQuarterFrame() {
+	a.pulse1.envelope.clock()
+	a.pulse2.envelope.clock()
+	a.triangle.clockLinear()
+	a.noise.envelope.clock()
+}
+
+func (a *APU) clockHalfFrame() {
+	a.pulse1.length.clock()
+	a.pulse1.clockSweep()
+	a.pulse2.length.clock()
+	a.pulse2.clockSweep()
+	a.triangle.length.clock()
+	a.noise.length.clock()
+}
+
+func (a *APU) mix() float32 {
+	p := a.pulse1.output() + a.pulse2.output()
+	tnd := 3*int(a.triangle.output()) + 2*int(a.noise.output()) + int(a.dmc.output())
+	return PULSE_MIX[p] + TND_MIX[tnd]
+}
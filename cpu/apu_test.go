@@ -0,0 +1,399 @@
+package cpu
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLengthCounterOnlyLoadsWhenEnabled(t *testing.T) {
+	a := NewAPU()
+	a.WriteToRegister(0x4003, 0b0000_1000)
+	if !(a.ReadStatus() == 0) {
+		t.Error("A disabled channel should not load its length counter")
+	}
+	a.WriteToRegister(0x4015, 0b0000_1111)
+	a.WriteToRegister(0x4003, 0b0000_1000)
+	a.WriteToRegister(0x4007, 0b0000_1000)
+	a.WriteToRegister(0x400B, 0b0000_1000)
+	a.WriteToRegister(0x400F, 0b0000_1000)
+	if !(a.ReadStatus() == 0b1111 && a.pulse1.length.value == 254) {
+		t.Errorf("Expected all length counters running, got status %08b", a.ReadStatus())
+	}
+	a.WriteToRegister(0x4015, 0b0000_1101)
+	if !(a.ReadStatus() == 0b1101) {
+		t.Error("Disabling a channel should clear its length counter")
+	}
+}
+
+func TestLengthCounterClockedTwicePerFrame(t *testing.T) {
+	a := NewAPU()
+	a.WriteToRegister(0x4015, 0b0001)
+	a.WriteToRegister(0x4003, 0b0001_1000) // length 2
+	for a.pulse1.length.value > 0 {
+		a.Tick(1)
+	}
+	// The sequence starts after the power-on write to $4017 settles
+	if !(a.pulse1.length.value == 0 && a.cycles == 3+uint(a.timing.FrameSteps[3])) {
+		t.Errorf("Length should run out on the fourth step, got %d at cycle %d", a.pulse1.length.value, a.cycles)
+	}
+}
+
+func TestLengthCounterHalt(t *testing.T) {
+	a := NewAPU()
+	a.WriteToRegister(0x4015, 0b0001)
+	a.WriteToRegister(0x4000, 0b0010_0000)
+	a.WriteToRegister(0x4003, 0b0001_1000)
+	for i := 0; i < 40000; i++ {
+		a.Tick(1)
+	}
+	if !(a.pulse1.length.value == 2) {
+		t.Error("Halted length counter should not count down")
+	}
+}
+
+func TestPulseMutedByLowPeriodAndSweepOverflow(t *testing.T) {
+	a := NewAPU()
+	a.WriteToRegister(0x4015, 0b0001)
+	a.WriteToRegister(0x4000, 0b1011_1111)
+	a.WriteToRegister(0x4002, 0x07)
+	a.WriteToRegister(0x4003, 0b0000_1000)
+	if !(a.pulse1.muted()) {
+		t.Error("Periods below 8 should mute the pulse")
+	}
+	a.WriteToRegister(0x4002, 0xFF)
+	a.WriteToRegister(0x4003, 0b0000_1111)
+	a.WriteToRegister(0x4001, 0b0000_0001)
+	if !(a.pulse1.muted()) {
+		t.Error("A sweep target above $7FF should mute the pulse even with the sweep off")
+	}
+}
+
+func TestSweepNegatesDifferentlyOnEachPulse(t *testing.T) {
+	a := NewAPU()
+	for _, p := range []*pulse{&a.pulse1, &a.pulse2} {
+		p.period = 0x100
+		p.writeSweep(0b1000_1001)
+	}
+	if !(a.pulse1.sweepTarget() == 0x7F && a.pulse2.sweepTarget() == 0x80) {
+		t.Errorf("Expected targets $7F and $80, got %X and %X", a.pulse1.sweepTarget(), a.pulse2.sweepTarget())
+	}
+}
+
+func TestEnvelopeDecaysAndLoops(t *testing.T) {
+	e := envelope{start: true}
+	e.write(0b0010_0000)
+	e.clock()
+	if !(e.output() == 15) {
+		t.Error("Envelope should restart at 15")
+	}
+	for i := 0; i < 15; i++ {
+		e.clock()
+	}
+	if !(e.output() == 0) {
+		t.Errorf("Envelope should have decayed to 0, got %d", e.output())
+	}
+	e.clock()
+	if !(e.output() == 15) {
+		t.Error("Looping envelope should wrap back to 15")
+	}
+}
+
+func TestTriangleNeedsLinearCounter(t *testing.T) {
+	a := NewAPU()
+	a.WriteToRegister(0x4015, 0b0100)
+	a.WriteToRegister(0x400A, 0x10)
+	a.WriteToRegister(0x400B, 0b0000_1000)
+	a.Tick(100)
+	if !(a.triangle.step == 0) {
+		t.Error("Triangle should not step before the linear counter is loaded")
+	}
+	a.WriteToRegister(0x4008, 0x7F)
+	a.WriteToRegister(0x400B, 0b0000_1000)
+	a.triangle.clockLinear()
+	a.Tick(17 * 4)
+	if !(a.triangle.step == 4) {
+		t.Errorf("Expected triangle at step 4, got %d", a.triangle.step)
+	}
+}
+
+func TestNoiseShiftRegisterModes(t *testing.T) {
+	n := noise{periods: NTSC_NOISE_PERIODS, shift: 1}
+	n.writePeriod(0)
+	n.clockTimer()
+	if !(n.shift == 0x4000) {
+		t.Errorf("Long mode should feed back bits 0 and 1, got %04X", n.shift)
+	}
+	n.shift = 1
+	n.timer = 0
+	n.writePeriod(0b1000_0000)
+	n.clockTimer()
+	if !(n.shift == 0x4000) {
+		t.Errorf("Short mode should feed back bits 0 and 6, got %04X", n.shift)
+	}
+	n.shift = 0b0100_0001
+	n.timer = 0
+	n.clockTimer()
+	if !(n.shift == 0b0010_0000) {
+		t.Errorf("Equal bits 0 and 6 should feed back 0, got %04X", n.shift)
+	}
+}
+
+func TestMixerIsNonlinear(t *testing.T) {
+	if !(math.Abs(float64(PULSE_MIX[30])-0.2575) < 0.001 && math.Abs(float64(TND_MIX[202])-0.7425) < 0.001) {
+		t.Errorf("Unexpected mixer maximums %f and %f", PULSE_MIX[30], TND_MIX[202])
+	}
+	if !(PULSE_MIX[30] < 2*PULSE_MIX[15]) {
+		t.Error("Mixing should compress loud outputs")
+	}
+}
+
+func TestSampleCallbackCalledEveryCycle(t *testing.T) {
+	a := NewAPU()
+	samples := 0
+	a.SetSampleCallback(func(v float32) { samples++ })
+	a.Tick(7)
+	if !(samples == 7) {
+		t.Errorf("Expected 7 samples, got %d", samples)
+	}
+}
+
+func TestDMCStartsSampleWhenEnabled(t *testing.T) {
+	a := NewAPU()
+	a.WriteToRegister(0x4012, 0x01)
+	a.WriteToRegister(0x4013, 0x01)
+	a.WriteToRegister(0x4015, 0b1_0000)
+	if !(a.dmc.addr == 0xC040 && a.dmc.remaining == 17 && a.ReadStatus() == 0b1_0000) {
+		t.Errorf("Sample not started, address %04X with %d bytes", a.dmc.addr, a.dmc.remaining)
+	}
+	a.WriteToRegister(0x4015, 0)
+	if !(a.ReadStatus() == 0 && !a.dmc.needsSample()) {
+		t.Error("Disabling the DMC should drop the rest of the sample")
+	}
+}
+
+func TestDMCRaisesIRQAtSampleEnd(t *testing.T) {
+	a := NewAPU()
+	a.WriteToRegister(0x4010, 0b1000_0000)
+	a.WriteToRegister(0x4015, 0b1_0000)
+	a.dmc.loadSample(0x00)
+	if !(a.IRQ() && a.ReadStatus()&0b1000_0000 != 0) {
+		t.Error("IRQ should be raised after the last byte")
+	}
+	a.WriteToRegister(0x4015, 0b1_0000)
+	if !(!a.IRQ()) {
+		t.Error("Writing $4015 should acknowledge the DMC IRQ")
+	}
+}
+
+func TestDMCLoopsWithoutIRQ(t *testing.T) {
+	a := NewAPU()
+	a.WriteToRegister(0x4010, 0b1100_0000)
+	a.WriteToRegister(0x4012, 0xFF)
+	a.WriteToRegister(0x4015, 0b1_0000)
+	a.dmc.loadSample(0x00)
+	if !(!a.IRQ() && a.dmc.remaining == 1 && a.dmc.addr == 0xFFC0) {
+		t.Error("Looping sample should restart instead of raising the IRQ")
+	}
+}
+
+func TestDMCAddressWrapsToRom(t *testing.T) {
+	d := dmc{addr: 0xFFFF, remaining: 2}
+	d.loadSample(0x00)
+	if !(d.addr == 0x8000) {
+		t.Errorf("Expected address to wrap to $8000, got %04X", d.addr)
+	}
+}
+
+func TestDMCOutputStepsAndClamps(t *testing.T) {
+	d := dmc{rate: 1, bits: 1, buffer: 0xFF, buffer_full: true}
+	d.writeLevel(124)
+	d.clockTimer()
+	for i := 0; i < 8; i++ {
+		d.clockTimer()
+	}
+	if !(d.level == 126) {
+		t.Errorf("Level should stop at 126, got %d", d.level)
+	}
+	d.buffer, d.buffer_full = 0x00, true
+	for i := 0; i < 8; i++ {
+		d.clockTimer()
+	}
+	d.writeLevel(1)
+	for i := 0; i < 8; i++ {
+		d.clockTimer()
+	}
+	if !(d.level == 1) {
+		t.Errorf("Level should not drop below 0, got %d", d.level)
+	}
+}
+
+// runFrameCounter ticks until the frame sequence has run for n cycles
+func runFrameCounter(a *APU, n uint) {
+	for a.reset_pending || a.reset_delay > 0 {
+		a.Tick(1)
+	}
+	for i := uint(0); i < n; i++ {
+		a.Tick(1)
+	}
+}
+
+func TestFrameIRQRaisedAtEndOfFourStepSequence(t *testing.T) {
+	a := NewAPU()
+	runFrameCounter(a, uint(a.timing.FrameSteps[3])-2)
+	if !(!a.IRQ()) {
+		t.Error("Frame IRQ raised too early")
+	}
+	a.Tick(1)
+	if !(a.IRQ() && a.ReadStatus()&0b0100_0000 != 0) {
+		t.Error("Frame IRQ should be raised a cycle before the last step")
+	}
+	if !(!a.IRQ() && a.ReadStatus()&0b0100_0000 == 0) {
+		t.Error("Reading $4015 should acknowledge the frame IRQ")
+	}
+	a.Tick(1)
+	if !(a.IRQ() && a.frame == a.timing.FrameSteps[3]) {
+		t.Error("Frame IRQ should be raised again on the last step")
+	}
+	a.ReadStatus()
+	a.Tick(1)
+	if !(a.IRQ() && a.frame == 0) {
+		t.Error("Frame IRQ should be raised as the sequence wraps")
+	}
+}
+
+func TestFrameIRQInhibit(t *testing.T) {
+	a := NewAPU()
+	runFrameCounter(a, uint(a.timing.FrameSteps[3]))
+	a.WriteToFrameCounter(0b0100_0000)
+	if !(!a.IRQ()) {
+		t.Error("Setting the inhibit flag should acknowledge the frame IRQ")
+	}
+	runFrameCounter(a, uint(a.timing.FrameSteps[3])+1)
+	if !(!a.IRQ()) {
+		t.Error("Inhibited frame counter should not raise the IRQ")
+	}
+}
+
+func TestFiveStepModeHasNoIRQ(t *testing.T) {
+	a := NewAPU()
+	a.WriteToFrameCounter(0b1000_0000)
+	runFrameCounter(a, uint(a.timing.FrameSteps[4])+1)
+	if !(!a.IRQ() && a.frame == 0) {
+		t.Errorf("Five step sequence should wrap after %d cycles without IRQ", a.timing.FrameSteps[4]+1)
+	}
+}
+
+func TestFiveStepWriteClocksImmediately(t *testing.T) {
+	a := NewAPU()
+	a.WriteToRegister(0x4015, 0b0001)
+	a.WriteToRegister(0x4003, 0b0001_1000) // length 2
+	a.WriteToFrameCounter(0b1000_0000)
+	runFrameCounter(a, 0)
+	if !(a.pulse1.length.value == 1) {
+		t.Errorf("Five step write should clock the length counter, got %d", a.pulse1.length.value)
+	}
+}
+
+func TestFrameCounterResetDelay(t *testing.T) {
+	a := NewAPU()
+	runFrameCounter(a, 100)
+	a.WriteToFrameCounter(0)
+	a.Tick(3)
+	if !(a.frame == 103) {
+		t.Error("The old sequence should keep running until the write settles")
+	}
+	// The write lands on the last ticked cycle
+	a.cycles = 1
+	a.WriteToFrameCounter(0)
+	a.Tick(1)
+	if !(a.reset_delay == 3) {
+		t.Error("A write on an APU cycle settles after 3 cycles")
+	}
+	a.cycles = 0
+	a.WriteToFrameCounter(0)
+	a.Tick(1)
+	if !(a.reset_delay == 4) {
+		t.Error("A write between APU cycles settles after 4 cycles")
+	}
+}
+
+func TestFrameCounterModeChangesWithRestart(t *testing.T) {
+	a := NewAPU()
+	runFrameCounter(a, 100)
+	a.WriteToFrameCounter(0b1000_0000)
+	a.Tick(1)
+	if !(!a.five_step) {
+		t.Error("The old mode should run until the sequence restarts")
+	}
+	// A second write replaces the first before it settles
+	a.WriteToFrameCounter(0)
+	runFrameCounter(a, 0)
+	if !(!a.five_step && a.frame == 0) {
+		t.Error("The last write should pick the mode")
+	}
+}
+
+func TestFrameCounterResetCountsFromWriteCycle(t *testing.T) {
+	// STA $4017, NOP, NOP
+	b := setupTestBus([]uint8{0x8D, 0x17, 0x40, 0xEA, 0xEA})
+	c := InitCPU(b)
+	c.Reset()
+	b.apu.cycles = 0
+	b.apu.reset_delay = 0
+	b.apu.frame = 100
+	c.Step(func() {})
+	// The write is on cycle 4, an APU cycle
+	if !(b.apu.reset_delay == 3 && b.apu.frame == 104) {
+		t.Errorf("Reset should be 3 cycles after the write, delay is %d", b.apu.reset_delay)
+	}
+	c.Step(func() {})
+	if !(b.apu.frame == 106) {
+		t.Error("The old sequence should keep running until the write settles")
+	}
+	c.Step(func() {})
+	if !(b.apu.frame == 1) {
+		t.Errorf("Sequence should restart on the third cycle after the write, at %d", b.apu.frame)
+	}
+}
+
+func TestFrameCounterResetDelayFollowsWriteCycleParity(t *testing.T) {
+	// LDA $10, STA $4017
+	b := setupTestBus([]uint8{0xA5, 0x10, 0x8D, 0x17, 0x40})
+	c := InitCPU(b)
+	c.Reset()
+	b.apu.cycles = 0
+	c.Step(func() {})
+	c.Step(func() {})
+	// The write is on cycle 7, between APU cycles
+	if !(b.apu.reset_delay == 4) {
+		t.Errorf("Reset should be 4 cycles after the write, delay is %d", b.apu.reset_delay)
+	}
+}
+
+// frameIRQDelay runs STA $4017 with the APU at the given cycle and counts
+// the cycles from the write until the frame IRQ flag is set
+func frameIRQDelay(start uint) uint {
+	b := setupTestBus([]uint8{0x8D, 0x17, 0x40})
+	c := InitCPU(b)
+	c.Reset()
+	b.apu.cycles = start
+	b.apu.reset_delay = 0
+	c.Step(func() {})
+	n := uint(0)
+	for !b.apu.frame_irq {
+		b.Tick(1)
+		n++
+	}
+	return n
+}
+
+func TestFrameIRQFlagSetCycleExactlyAfterWrite(t *testing.T) {
+	// The write lands on an APU cycle
+	if n := frameIRQDelay(0); !(n == 29831) {
+		t.Errorf("Frame IRQ flag should be set 29831 cycles after the write, got %d", n)
+	}
+	// And between two
+	if n := frameIRQDelay(1); !(n == 29832) {
+		t.Errorf("Frame IRQ flag should be set 29832 cycles after the write, got %d", n)
+	}
+}
@@ -1,86 +1,276 @@
 package cpu
 
+import "math/rand"
+
 const RAM uint16 = 0x0000
 const RAM_MIRRORS_END uint16 = 0x1FFF
 const PPU_REGISTERS uint16 = 0x2000
 const PPU_REGISTERS_MIRRORS_END uint16 = 0x3FFF
+const PRG_RAM uint16 = 0x6000
+const PRG_RAM_END uint16 = 0x7FFF
+const OAM_DMA_CYCLES uint = 513
+
+// A DMC sample fetch halts the CPU for 4 cycles, or 2 when it lands in the
+// middle of an OAM DMA
+const DMC_DMA_CYCLES uint = 4
+const DMC_DMA_OAM_CYCLES uint = 2
+
+type RamPattern uint8
+
+const (
+	RAM_ZEROS RamPattern = iota
+	RAM_ONES
+	RAM_RANDOM
+	RAM_HARDWARE
+)
 
 type Bus struct {
 	cpu_vram     [2048]uint8
 	rom          *Rom
 	ppu          *PPU
+	apu          *APU
 	cycles       uint
 	gameCallback func(*PPU)
 	Joypad       *Joypad
+	data_bus     uint8
+	region       Region
+	timing       Timing
+	dot_rest     uint // dots owed to the PPU when the ratio is not whole
+	oam_dma      bool
+	// A $4014 write starts the DMA once the writing instruction is done
+	oam_dma_pending bool
+	oam_dma_page    uint8
+	dmc_dma         bool
+	joypad_read     bool // the CPU read $4016 during the cycles being ticked
+	// Length of the instruction making its accesses, and how many of its
+	// cycles were ticked early so a $2002 or $4015 read sees its own cycle
+	instr_cycles uint8
+	ticked_ahead uint8
 }
 
 func InitBus(r *Rom, c func(*PPU)) *Bus {
 	p := NewPPU(r.chr_rom, r.screen_mirroring)
+	p.SetNametables(r.Nametables())
+	p.SetCHRWritable(r.HasCHRRam())
 	j := NewJoypad()
-	return &Bus{
+	b := &Bus{
 		rom:          r,
 		ppu:          p,
+		apu:          NewAPU(),
 		gameCallback: c,
 		Joypad:       j,
 	}
+	b.SetRegion(r.GetRegion())
+	return b
 }
 
+// PowerOn puts the bus and everything attached to it in its power-up state.
+// The seed is only used by RAM_RANDOM
+func (b *Bus) PowerOn(pattern RamPattern, seed int64) {
+	fillRam(b.cpu_vram[:], pattern, seed)
+	b.cycles = 0
+	b.ppu.PowerOn()
+	b.apu.PowerOn()
+	b.rom.PowerOn(pattern, seed)
+	b.Joypad.reset()
+}
+
+// SoftReset mirrors the console reset button, RAM and the cycle count
+// are left untouched
+func (b *Bus) SoftReset() {
+	b.ppu.SoftReset()
+	b.apu.SoftReset()
+	b.rom.SoftReset()
+}
+
+// fillRam puts the power-up pattern in ram
+func fillRam(ram []uint8, pattern RamPattern, seed int64) {
+	switch pattern {
+	case RAM_ZEROS:
+		clear(ram)
+	case RAM_ONES:
+		for i := range ram {
+			ram[i] = 0xFF
+		}
+	case RAM_RANDOM:
+		r := rand.New(rand.NewSource(seed))
+		for i := range ram {
+			ram[i] = uint8(r.Intn(256))
+		}
+	case RAM_HARDWARE:
+		// Most consoles power up with alternating runs of 4 bytes of $00 and $FF
+		for i := range ram {
+			if i&0b100 == 0 {
+				ram[i] = 0x00
+			} else {
+				ram[i] = 0xFF
+			}
+		}
+	default:
+		panic("Unknown ram pattern")
+	}
+}
+
+// Tick runs the cycles of one CPU access or instruction, whose reads come
+// last, one cycle at a time so DMC fetches can halt the CPU. The CPU makes
+// its accesses before ticking, so writes whose effect starts after the
+// write cycle are applied here once the instruction's cycles have passed.
+// Cycles already run ahead of a read are not run again
 func (b *Bus) Tick(cycles uint8) {
-	b.cycles += uint(cycles)
-	newFrame := b.ppu.Tick(cycles * 3)
+	skip := min(cycles, b.ticked_ahead)
+	b.ticked_ahead -= skip
+	for i := skip; i < cycles; i++ {
+		b.tickCycle(i == cycles-1)
+	}
+	b.instr_cycles = 0
+	b.joypad_read = false
+	b.apu.startFrameCounterReset()
+	if b.oam_dma_pending {
+		b.oam_dma_pending = false
+		b.runOAMDMA(b.oam_dma_page)
+	}
+}
+
+// BeginInstruction is told the length of the instruction whose accesses
+// come next
+func (b *Bus) BeginInstruction(cycles uint8) {
+	b.instr_cycles = cycles
+}
+
+// tickToReadCycle runs the cycles before the instruction's read, which is
+// its last cycle, ahead of the Tick that follows the accesses. Only reads
+// whose result depends on the exact cycle need it
+func (b *Bus) tickToReadCycle() {
+	for b.ticked_ahead+1 < b.instr_cycles {
+		b.tickCycle(false)
+		b.ticked_ahead++
+	}
+}
+
+func (b *Bus) tickCycle(last bool) {
+	b.cycles++
+	b.dot_rest += b.timing.DotsPerCycle
+	dots := b.dot_rest / b.timing.DotsPerCycleDiv
+	b.dot_rest %= b.timing.DotsPerCycleDiv
+	newFrame := b.ppu.Tick(uint8(dots))
+	b.apu.tickCycle()
 	if newFrame {
 		b.gameCallback(b.ppu)
 	}
+	if !b.dmc_dma && b.apu.dmc.needsSample() {
+		b.runDMCDMA(last && b.joypad_read)
+	}
+}
+
+// The DMC halts the CPU and reads its sample byte through the bus. When the
+// halt lands on a read of $4016 the CPU repeats that read, which clocks the
+// controller once more and loses a button bit
+func (b *Bus) runDMCDMA(onJoypadRead bool) {
+	b.dmc_dma = true
+	if onJoypadRead {
+		b.Joypad.ReadData()
+	}
+	stall := DMC_DMA_CYCLES
+	if b.oam_dma {
+		stall = DMC_DMA_OAM_CYCLES
+	}
+	for i := uint(0); i < stall; i++ {
+		b.tickCycle(false)
+	}
+	b.apu.dmc.loadSample(b.MemRead(b.apu.dmc.addr))
+	b.dmc_dma = false
+}
+
+// Read and Write let the bus serve as the CPU's Memory
+func (b *Bus) Read(addr uint16) uint8 {
+	return b.MemRead(addr)
+}
+
+func (b *Bus) Write(addr uint16, v uint8) {
+	b.MemWrite(addr, v)
 }
 
 func (b *Bus) MemRead(addr uint16) uint8 {
+	v := b.read(addr)
+	if addr == 0x4016 {
+		b.joypad_read = true
+	}
+	// $4015 sits inside the CPU, reading it does not drive the external bus
+	if addr != APU_STATUS {
+		b.data_bus = v
+	}
+	return v
+}
+
+// Peek reads RAM, cartridge RAM and PRG ROM without touching the data bus,
+// anything else reads as the current open bus value. It is meant for
+// debuggers and test harnesses that must not disturb the emulation
+func (b *Bus) Peek(addr uint16) uint8 {
+	if addr <= RAM_MIRRORS_END || (addr >= PRG_RAM && addr <= PRG_RAM_END) || addr >= 0x8000 {
+		return b.read(addr)
+	}
+	return b.data_bus
+}
+
+// Addresses nothing drives keep the last value seen on the data bus,
+// which is what read returns for them
+func (b *Bus) read(addr uint16) uint8 {
 	if addr >= RAM && addr <= RAM_MIRRORS_END {
 		mirr_address_down := addr & 0b00000111_11111111
 		return b.cpu_vram[mirr_address_down]
 	} else if addr >= PPU_REGISTERS && addr <= PPU_REGISTERS_MIRRORS_END {
-		switch addr {
-		case 0x2000 | 0x2001 | 0x2003 | 0x2005 | 0x2006 | 0x4014:
-			panic("Attempt to read from write-only PPU address")
+		mirror_address_down := addr & 0b00100000_00000111
+		switch mirror_address_down {
 		case 0x2002:
+			// Vblank suppression depends on the exact dot of the read
+			b.tickToReadCycle()
 			return b.ppu.ReadStatusRegister()
 		case 0x2004:
 			return b.ppu.ReadOAMData()
 		case 0x2007:
 			return b.ppu.ReadData()
-		default:
-			if addr >= 0x2008 && addr <= PPU_REGISTERS_MIRRORS_END {
-				mirror_address_down := addr & 0b00100000_00000111
-				b.MemRead(mirror_address_down)
-			} else if addr >= 0x8000 && addr <= 0xFFFF {
-				b.readPgrRom(addr)
-			}
 		}
+		return b.ppu.OpenBus()
+	} else if addr >= PRG_RAM && addr <= PRG_RAM_END {
+		return b.rom.prg_ram[addr-PRG_RAM]
 	} else if addr >= 0x8000 && addr <= 0xFFFF {
 		return b.readPgrRom(addr)
+	} else if addr == APU_STATUS {
+		// The frame IRQ flag is timed to the cycle
+		b.tickToReadCycle()
+		return (b.data_bus & 0b0010_0000) | b.apu.ReadStatus()
 	} else if addr == 0x4016 {
-		return b.Joypad.ReadData()
+		// Only the low bits are driven by the controller port
+		return (b.data_bus & 0b1110_0000) | b.Joypad.ReadData()
+	} else if addr == 0x4017 {
+		return b.data_bus & 0b1110_0000
 	}
-	return 0
+	return b.data_bus
 }
 
 func (b *Bus) MemWrite(addr uint16, val uint8) {
-
+	b.data_bus = val
 	if addr >= RAM && addr <= RAM_MIRRORS_END {
 		mirr_address_down := addr & 0b11111111111
 		b.cpu_vram[mirr_address_down] = val
 	} else if addr >= 0x2008 && addr <= PPU_REGISTERS_MIRRORS_END {
 		mirror_down_addr := addr & 0b00100000_00000111
 		b.MemWrite(mirror_down_addr, val)
+	} else if addr >= PRG_RAM && addr <= PRG_RAM_END {
+		b.rom.prg_ram[addr-PRG_RAM] = val
 	} else if addr >= 0x8000 && addr <= 0xFFFF {
 		panic("Attempt to write to rom space")
+	} else if (addr >= APU_REGISTERS && addr <= APU_REGISTERS_END) || addr == APU_STATUS || addr == APU_FRAME_COUNTER {
+		b.apu.WriteToRegister(addr, val)
 	} else {
+		if addr >= PPU_REGISTERS && addr <= 0x2007 {
+			b.ppu.WriteToRegister(val)
+		}
 		switch addr {
 		case 0x2000:
 			b.ppu.WriteToPPUCtrl(val)
 		case 0x2001:
 			b.ppu.WriteToMask(val)
-		case 0x2002:
-			panic("Trying to write to ppu status register")
 		case 0x2003:
 			b.ppu.WriteToOAMAddr(val)
 		case 0x2004:
@@ -92,22 +282,76 @@ func (b *Bus) MemWrite(addr uint16, val uint8) {
 		case 0x2007:
 			b.ppu.WriteToData(val)
 		case 0x4014:
-			buf := [256]uint8{}
-			hi := uint16(val) << 8
-			for i := range buf {
-				buf[i] = b.MemRead(hi + uint16(i))
-			}
-			b.ppu.WriteToOAMDMA(&buf)
+			b.oam_dma_pending = true
+			b.oam_dma_page = val
 		case 0x4016:
 			b.Joypad.WriteData(val)
 		}
 	}
 }
 
+func (b *Bus) isOddCycle() bool {
+	return b.cycles%2 == 1
+}
+
+// The CPU is halted while OAM DMA copies the page, 513 cycles plus one
+// extra alignment cycle when the transfer starts on an odd cycle
+func (b *Bus) runOAMDMA(page uint8) {
+	buf := [256]uint8{}
+	hi := uint16(page) << 8
+	for i := range buf {
+		buf[i] = b.MemRead(hi + uint16(i))
+	}
+	b.ppu.WriteToOAMDMA(&buf)
+	stall := OAM_DMA_CYCLES
+	if b.isOddCycle() {
+		stall++
+	}
+	b.oam_dma = true
+	for i := uint(0); i < stall; i++ {
+		b.tickCycle(false)
+	}
+	b.oam_dma = false
+}
+
+func (b *Bus) Frame() *Frame {
+	return b.ppu.Frame()
+}
+
+func (b *Bus) SetRenderMode(m RenderMode) {
+	b.ppu.SetRenderMode(m)
+}
+
+// SetRegion overrides the region from the cartridge header
+func (b *Bus) SetRegion(r Region) {
+	b.region = r
+	b.timing = r.Timing()
+	b.dot_rest = 0
+	b.ppu.SetRegion(r)
+	b.apu.SetRegion(r)
+}
+
+func (b *Bus) Region() Region {
+	return b.region
+}
+
+// SetSampleCallback receives the APU mixer output once per CPU cycle
+func (b *Bus) SetSampleCallback(f func(float32)) {
+	b.apu.SetSampleCallback(f)
+}
+
+func (b *Bus) SetNoSpriteLimit(on bool) {
+	b.ppu.SetNoSpriteLimit(on)
+}
+
 func (b *Bus) PollNMIStatus() *uint8 {
 	return b.ppu.PollNMIStatus()
 }
 
+func (b *Bus) IRQLine() bool {
+	return b.apu.IRQ()
+}
+
 func (b *Bus) readPgrRom(addr uint16) uint8 {
 	addr -= 0x8000
 	if len(b.rom.prg_rom) == 0x4000 && addr >= 0x4000 {
@@ -0,0 +1,331 @@
+package cpu
+
+import "testing"
+
+// runStoreToOAMDMA executes a single store to $4014 starting at the given cycle
+// count and returns the cycles it took including the DMA
+func runStoreToOAMDMA(program []uint8, start uint) uint {
+	b := setupTestBus(program)
+	c := InitCPU(b)
+	c.Reset()
+	c.register_x = 0
+	c.register_y = 0
+	// Pointer for the ($nn),Y store
+	b.cpu_vram[0x10] = 0x14
+	b.cpu_vram[0x11] = 0x40
+	b.cycles = start
+	c.Step(func() {})
+	return b.cycles - start
+}
+
+func TestOAMDMAStallsOnEvenCycle(t *testing.T) {
+	// STA $4014 ends on cycle 14
+	if cycles := runStoreToOAMDMA([]uint8{0x8D, 0x14, 0x40}, 10); !(cycles == 4+513) {
+		t.Errorf("Wrong DMA stall, expected %d cycles but got %d", 4+513, cycles)
+	}
+}
+
+func TestOAMDMAStallsOnOddCycle(t *testing.T) {
+	// STA $4014 ends on cycle 15
+	if cycles := runStoreToOAMDMA([]uint8{0x8D, 0x14, 0x40}, 11); !(cycles == 4+514) {
+		t.Errorf("Wrong DMA stall, expected %d cycles but got %d", 4+514, cycles)
+	}
+}
+
+func TestOAMDMAAlignsOnCycleAfterWrite(t *testing.T) {
+	// STA $4014,X takes 5 cycles, so it ends on an odd cycle from an even start
+	if cycles := runStoreToOAMDMA([]uint8{0x9D, 0x14, 0x40}, 10); !(cycles == 5+514) {
+		t.Errorf("Wrong DMA stall after STA abs,X, expected %d cycles but got %d", 5+514, cycles)
+	}
+	if cycles := runStoreToOAMDMA([]uint8{0x9D, 0x14, 0x40}, 11); !(cycles == 5+513) {
+		t.Errorf("Wrong DMA stall after STA abs,X, expected %d cycles but got %d", 5+513, cycles)
+	}
+	// STA ($10),Y takes 6 cycles
+	if cycles := runStoreToOAMDMA([]uint8{0x91, 0x10}, 11); !(cycles == 6+514) {
+		t.Errorf("Wrong DMA stall after STA (ind),Y, expected %d cycles but got %d", 6+514, cycles)
+	}
+}
+
+func TestOAMDMAStartsAfterWritingInstruction(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.MemWrite(0x4014, 0x02)
+	if !(b.cycles == 0) {
+		t.Error("DMA should wait for the writing instruction to finish")
+	}
+	b.Tick(4)
+	if !(b.cycles == 4+513) {
+		t.Errorf("Wrong DMA stall, expected %d cycles but got %d", 4+513, b.cycles)
+	}
+}
+
+func TestOAMDMACopiesPageToOAM(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.MemWrite(0x0200, 0x25)
+	b.MemWrite(0x02FF, 0x15)
+	b.MemWrite(0x4014, 0x02)
+	b.Tick(4)
+	if !(b.ppu.oam_data[0] == 0x25 && b.ppu.oam_data[255] == 0x15) {
+		t.Error("OAM data not copied by DMA")
+	}
+}
+
+func TestOAMDMAAdvancesPPU(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.MemWrite(0x4014, 0x02)
+	b.Tick(4)
+	// 517 CPU cycles is 1551 PPU dots, which is 4 full scanlines plus 187 dots
+	if !(b.ppu.scanline == 4 && b.ppu.cycles == 187) {
+		t.Errorf("PPU not advanced by DMA, at scanline %d dot %d", b.ppu.scanline, b.ppu.cycles)
+	}
+}
+
+func TestPowerOnFillsRamWithOnes(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.PowerOn(RAM_ONES, 0)
+	if !(b.MemRead(0x0000) == 0xFF && b.MemRead(0x07FF) == 0xFF) {
+		t.Error("RAM not filled with $FF")
+	}
+}
+
+func TestPowerOnFillsPRGRamWithoutBattery(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.MemWrite(0x6000, 0x25)
+	b.PowerOn(RAM_ONES, 0)
+	if !(b.MemRead(0x6000) == 0xFF && b.MemRead(0x7FFF) == 0xFF) {
+		t.Error("PRG RAM without a battery should be filled on power on")
+	}
+	b.MemWrite(0x6000, 0x25)
+	b.SoftReset()
+	if !(b.MemRead(0x6000) == 0x25) {
+		t.Error("PRG RAM should keep its contents over a reset")
+	}
+}
+
+func TestPowerOnKeepsBatteryBackedPRGRam(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.rom.battery = true
+	b.MemWrite(0x6000, 0x25)
+	b.PowerOn(RAM_ONES, 0)
+	if !(b.MemRead(0x6000) == 0x25) {
+		t.Error("Battery backed PRG RAM should keep its contents")
+	}
+}
+
+func TestPowerOnFillsRamWithHardwarePattern(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.PowerOn(RAM_HARDWARE, 0)
+	if !(b.MemRead(0x0003) == 0x00 && b.MemRead(0x0004) == 0xFF && b.MemRead(0x0008) == 0x00) {
+		t.Error("RAM not filled with hardware pattern")
+	}
+}
+
+func TestPowerOnRandomRamIsSeeded(t *testing.T) {
+	b1 := setupTestBus([]uint8{})
+	b2 := setupTestBus([]uint8{})
+	b1.PowerOn(RAM_RANDOM, 42)
+	b2.PowerOn(RAM_RANDOM, 42)
+	if !(b1.cpu_vram == b2.cpu_vram) {
+		t.Error("RAM with the same seed should match")
+	}
+	b2.PowerOn(RAM_RANDOM, 43)
+	if b1.cpu_vram == b2.cpu_vram {
+		t.Error("RAM with different seeds should differ")
+	}
+}
+
+func TestPowerOnResetsCycles(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.Tick(100)
+	b.PowerOn(RAM_ZEROS, 0)
+	if !(b.cycles == 0) {
+		t.Errorf("Cycles not reset, got %d", b.cycles)
+	}
+}
+
+func TestUnmappedReadReturnsOpenBus(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.MemWrite(0x0010, 0x25)
+	b.MemRead(0x0010)
+	if !(b.MemRead(0x5000) == 0x25) {
+		t.Error("Unmapped read should return the last bus value")
+	}
+	b.MemWrite(0x0010, 0x15)
+	if !(b.MemRead(0x4018) == 0x15) {
+		t.Error("Unmapped read should return the last written value")
+	}
+}
+
+func TestJoypadReadKeepsOpenBusUpperBits(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.Joypad.SetButtonPressedStatus(ButtonA, true)
+	b.MemWrite(0x4016, 1)
+	b.MemWrite(0x4016, 0)
+	// The upper byte of the address is the last value on the bus for LDA $4016
+	b.data_bus = 0x40
+	if !(b.MemRead(0x4016) == 0x41) {
+		t.Error("Joypad read should keep open bus upper bits")
+	}
+	b.data_bus = 0x40
+	if !(b.MemRead(0x4017) == 0x40) {
+		t.Error("Second port read should return open bus upper bits")
+	}
+}
+
+func TestWriteOnlyPPURegisterReadReturnsOpenBus(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	// Any register write, even to the read only status, sets the PPU latch
+	b.MemWrite(0x2002, 0x25)
+	b.data_bus = 0
+	if !(b.MemRead(0x2000) == 0x25 && b.MemRead(0x3FF8) == 0x25) {
+		t.Error("Write only PPU register should return the PPU open bus")
+	}
+}
+
+func TestReadsAndWritesPrgRam(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.MemWrite(0x6000, 0x25)
+	b.MemWrite(0x7FFF, 0x15)
+	if !(b.MemRead(0x6000) == 0x25 && b.MemRead(0x7FFF) == 0x15) {
+		t.Error("PRG RAM not read back")
+	}
+}
+
+func TestPeekDoesNotChangeDataBus(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.MemWrite(0x6004, 0x25)
+	b.MemWrite(0x0010, 0x15)
+	if !(b.Peek(0x6004) == 0x25 && b.Peek(0x2002) == 0x15 && b.data_bus == 0x15) {
+		t.Error("Peek should not change the data bus")
+	}
+}
+
+func TestPALBusRunsSixteenDotsPerFiveCycles(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.SetRegion(REGION_PAL)
+	for i := 0; i < 5; i++ {
+		b.Tick(1)
+	}
+	if !(b.ppu.cycles == 16) {
+		t.Errorf("Expected 16 dots after 5 cycles, got %d", b.ppu.cycles)
+	}
+}
+
+func TestAPUStatusReadKeepsOpenBus(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.MemWrite(0x4015, 0b0000_0001)
+	b.MemWrite(0x4003, 0b1111_1000)
+	if !(b.MemRead(0x4015) == 0b0010_0001) {
+		t.Errorf("Expected bit 5 from open bus and pulse 1 running, got %08b", b.MemRead(0x4015))
+	}
+	b.data_bus = 0x00
+	b.MemRead(0x4015)
+	if !(b.data_bus == 0x00) {
+		t.Error("Reading $4015 should not change the data bus")
+	}
+}
+
+func TestDMCFetchStallsCPUAndReadsRom(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.rom.prg_rom[0x4000] = 0xA5
+	b.MemWrite(0x4015, 0b1_0000)
+	b.Tick(1)
+	if !(b.cycles == 1+DMC_DMA_CYCLES && b.apu.dmc.buffer == 0xA5 && b.data_bus == 0xA5) {
+		t.Errorf("Expected a %d cycle stall reading $C000, got %d cycles and %02X", DMC_DMA_CYCLES, b.cycles-1, b.apu.dmc.buffer)
+	}
+	if !(b.apu.dmc.remaining == 0 && !b.apu.dmc.needsSample()) {
+		t.Error("The one byte sample should be fully read")
+	}
+}
+
+func TestDMCFetchDuringOAMDMAStallsLess(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.MemWrite(0x4015, 0b1_0000)
+	b.cycles = 0
+	// Start the DMA directly, ticking a writing instruction would fetch first
+	b.runOAMDMA(0x02)
+	if !(b.cycles == OAM_DMA_CYCLES+DMC_DMA_OAM_CYCLES) {
+		t.Errorf("Expected %d cycles, got %d", OAM_DMA_CYCLES+DMC_DMA_OAM_CYCLES, b.cycles)
+	}
+}
+
+func TestDMCFetchOnJoypadReadDropsBit(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.Joypad.SetButtonPressedStatus(ButtonB, true)
+	b.MemWrite(0x4016, 1)
+	b.MemWrite(0x4016, 0)
+	b.MemWrite(0x4015, 0b1_0000)
+	// The fetch lands on the cycle A is read
+	if !(b.MemRead(0x4016)&1 == 0) {
+		t.Error("A should not be pressed")
+	}
+	b.Tick(1)
+	if !(b.MemRead(0x4016)&1 == 0) {
+		t.Error("The DMC fetch should have clocked B out of the controller")
+	}
+}
+
+func TestDMCFetchAwayFromJoypadReadKeepsBits(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.Joypad.SetButtonPressedStatus(ButtonB, true)
+	b.MemWrite(0x4016, 1)
+	b.MemWrite(0x4016, 0)
+	b.MemRead(0x4016)
+	b.Tick(4)
+	b.MemWrite(0x4015, 0b1_0000)
+	b.Tick(4)
+	if !(b.MemRead(0x4016)&1 == 1) {
+		t.Error("B should still be read")
+	}
+}
+
+func TestBusIRQLineFollowsDMC(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.MemWrite(0x4010, 0b1000_0000)
+	b.MemWrite(0x4015, 0b1_0000)
+	b.Tick(1)
+	if !(b.IRQLine()) {
+		t.Error("IRQ line should be asserted after the sample ends")
+	}
+	b.MemWrite(0x4010, 0)
+	if !(!b.IRQLine()) {
+		t.Error("Clearing the IRQ enable should release the line")
+	}
+}
+
+func setupCHRRamBus() *Bus {
+	header := []uint8{0x4e, 0x45, 0x53, 0x1a, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	mem := make([]uint8, 16+2*PRG_ROM_PG_SIZE)
+	copy(mem, header)
+	return InitBus(InitRom(mem), func(*PPU) {})
+}
+
+func TestCHRRamWrittenThroughPPUData(t *testing.T) {
+	b := setupCHRRamBus()
+	b.MemWrite(0x2006, 0x00)
+	b.MemWrite(0x2006, 0x00)
+	b.MemWrite(0x2007, 0x25)
+	b.MemWrite(0x2006, 0x00)
+	b.MemWrite(0x2006, 0x00)
+	b.MemRead(0x2007)
+	if v := b.MemRead(0x2007); !(v == 0x25) {
+		t.Errorf("Expected $25 read back from CHR RAM, got %02X", v)
+	}
+}
+
+func TestCHRRomIgnoresPPUDataWrites(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.MemWrite(0x2006, 0x00)
+	b.MemWrite(0x2006, 0x00)
+	b.MemWrite(0x2007, 0x25)
+	if !(b.ppu.chr_rom[0] == 0x00) {
+		t.Error("CHR ROM should not be writable")
+	}
+}
+
+func TestRendersWithCHRRam(t *testing.T) {
+	b := setupCHRRamBus()
+	b.ppu.WriteToMask(0b0001_1000)
+	for i := 0; i < 30000; i++ {
+		b.Tick(1)
+	}
+}
@@ -2,6 +2,8 @@ package cpu
 
 const PRG_ROM_PG_SIZE = 16384
 const CHR_ROM_PG_SIZE = 8192
+const PRG_RAM_SIZE = 8192
+const CHR_RAM_SIZE = 8192
 
 var NESTAG string = string([]byte{0x4E, 0x45, 0x53, 0x1A})
 
@@ -15,9 +17,13 @@ const (
 
 type Rom struct {
 	prg_rom          []uint8
-	chr_rom          []uint8
+	chr_rom          []uint8 // CHR RAM when the header declares no CHR ROM
+	chr_ram          bool
 	mapper           uint8
 	screen_mirroring Mirroring
+	region           Region
+	prg_ram          [PRG_RAM_SIZE]uint8
+	battery          bool // PRG RAM is kept alive while the console is off
 }
 
 func InitRom(data []uint8) *Rom {
@@ -26,11 +32,20 @@ func InitRom(data []uint8) *Rom {
 	}
 	mapper := (data[7] & 0b1111_0000) | (data[6] >> 4)
 	ines_vers := ((data[7] & 0b0000_1100) >> 2)
-	if ines_vers > 0 {
-		panic("Currently only ines version 1.0 is supported")
+	if ines_vers != 0 && ines_vers != 2 {
+		panic("Currently only ines version 1.0 and NES 2.0 are supported")
 	}
+	is_nes2 := ines_vers == 2
 	rom_size := uint(data[4]) * PRG_ROM_PG_SIZE
 	chr_size := uint(data[5]) * CHR_ROM_PG_SIZE
+	if is_nes2 {
+		// Mappers above 255 and submappers are not supported yet
+		if data[8] != 0 {
+			panic("Currently only mappers up to 255 without submapper are supported")
+		}
+		rom_size = nes2RomSize(data[4], data[9]&0x0F, PRG_ROM_PG_SIZE)
+		chr_size = nes2RomSize(data[5], data[9]>>4, CHR_ROM_PG_SIZE)
+	}
 	skip_trainer := (data[6] & 0b100) != 0
 	var prg_rom_start uint
 	if skip_trainer {
@@ -39,9 +54,20 @@ func InitRom(data []uint8) *Rom {
 		prg_rom_start = 16
 	}
 	chr_rom_start := prg_rom_start + rom_size
-	for _, v := range data[9:15] {
-		if v != 0x00 {
-			panic("Wrong reserved header, all should be 0")
+	// NES 2.0 uses the bytes iNES 1.0 leaves reserved
+	region := REGION_NTSC
+	if is_nes2 {
+		switch data[12] & 0b11 {
+		case 1:
+			region = REGION_PAL
+		case 3:
+			region = REGION_DENDY
+		}
+	} else {
+		for _, v := range data[9:15] {
+			if v != 0x00 {
+				panic("Wrong reserved header, all should be 0")
+			}
 		}
 	}
 	is_vertical := (data[6] & 0x01) > 0
@@ -54,14 +80,72 @@ func InitRom(data []uint8) *Rom {
 	} else {
 		mirroring = HORIZONTAL
 	}
+	chr_rom := data[chr_rom_start:(chr_rom_start + chr_size)]
+	// Without CHR ROM the cartridge has 8KB of CHR RAM instead
+	chr_ram := chr_size == 0
+	if chr_ram {
+		chr_rom = make([]uint8, CHR_RAM_SIZE)
+	}
 	return &Rom{
 		prg_rom:          data[prg_rom_start:(prg_rom_start + rom_size)],
-		chr_rom:          data[chr_rom_start:(chr_rom_start + chr_size)],
+		chr_rom:          chr_rom,
+		chr_ram:          chr_ram,
 		mapper:           mapper,
 		screen_mirroring: mirroring,
+		region:           region,
+		battery:          data[6]&0b10 != 0,
+	}
+}
+
+// nes2RomSize combines a size byte with its upper nibble from byte 9. An
+// upper nibble of $F turns the byte into exponent and multiplier, EEEEEEMM
+// for 2^E * (MM*2+1) bytes
+func nes2RomSize(lsb uint8, msb uint8, page uint) uint {
+	if msb == 0x0F {
+		return (1 << (lsb >> 2)) * (uint(lsb&0b11)*2 + 1)
 	}
+	return (uint(msb)<<8 | uint(lsb)) * page
+}
+
+func (r *Rom) GetMapper() uint8 {
+	return r.mapper
+}
+
+// GetRegion is the region from a NES 2.0 header, NTSC otherwise. Multi
+// region cartridges run as NTSC
+func (r *Rom) GetRegion() Region {
+	return r.region
+}
+
+func (r *Rom) GetPRGRom() []uint8 {
+	return r.prg_rom
 }
 
 func (r *Rom) GetCHRRom() []uint8 {
 	return r.chr_rom
 }
+
+// HasCHRRam is true when the pattern tables are RAM the CPU can write
+func (r *Rom) HasCHRRam() bool {
+	return r.chr_ram
+}
+
+// Nametables is the cartridge's own nametable storage, nil when the PPU's
+// VRAM is used with the header mirroring. Four screen RAM is plain memory
+// and lives in the PPU's VRAM as well
+func (r *Rom) Nametables() Nametables {
+	return nil
+}
+
+// PowerOn gives PRG RAM without a battery the same power-up contents as
+// the console RAM, battery backed RAM keeps what it had
+func (r *Rom) PowerOn(pattern RamPattern, seed int64) {
+	if !r.battery {
+		fillRam(r.prg_ram[:], pattern, seed)
+	}
+}
+
+// SoftReset is where mapper registers return to their initial state, NROM
+// has none
+func (r *Rom) SoftReset() {
+}
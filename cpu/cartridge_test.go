@@ -111,3 +111,76 @@ func TestCreatesRomWithHorizontalNoMapperAnd2PrgPg3ChrPg(t *testing.T) {
 		t.Error("Length of prg rom not correct")
 	}
 }
+
+func TestCreatesPALRomFromNES2Header(t *testing.T) {
+	test_header := []uint8{0x4e, 0x45, 0x53, 0x1a, 0x01, 0x01, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}
+	test_data := setupDataArray(test_header)
+	actual := InitRom(test_data)
+	if !(actual.GetRegion() == REGION_PAL) {
+		t.Error("Region not read from the NES 2.0 header")
+	}
+}
+
+func TestCreatesDendyRomFromNES2Header(t *testing.T) {
+	test_header := []uint8{0x4e, 0x45, 0x53, 0x1a, 0x01, 0x01, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00}
+	test_data := setupDataArray(test_header)
+	actual := InitRom(test_data)
+	if !(actual.GetRegion() == REGION_DENDY) {
+		t.Error("Region not read from the NES 2.0 header")
+	}
+}
+
+func TestCreatesRomWithNES2SizeMSB(t *testing.T) {
+	test_header := []uint8{0x4e, 0x45, 0x53, 0x1a, 0x02, 0x01, 0x00, 0x08, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	test_data := setupDataArray(test_header)
+	test_data = append(test_data, make([]uint8, 257*CHR_ROM_PG_SIZE)...)
+	actual := InitRom(test_data)
+	if !(len(actual.prg_rom) == 2*PRG_ROM_PG_SIZE) {
+		t.Error("Length of prg rom not correct")
+	}
+	if !(len(actual.chr_rom) == 257*CHR_ROM_PG_SIZE) {
+		t.Error("Length of chr rom not correct")
+	}
+}
+
+func TestCreatesRomWithNES2ExponentSize(t *testing.T) {
+	// PRG is 2^14 * 3 bytes, CHR is 2^13 * 1
+	test_header := []uint8{0x4e, 0x45, 0x53, 0x1a, 0x39, 0x34, 0x00, 0x08, 0x00, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	test_data := setupDataArray(test_header)
+	actual := InitRom(test_data)
+	if !(len(actual.prg_rom) == 3*PRG_ROM_PG_SIZE) {
+		t.Error("Length of prg rom not correct")
+	}
+	if !(len(actual.chr_rom) == 1*CHR_ROM_PG_SIZE) {
+		t.Error("Length of chr rom not correct")
+	}
+}
+
+func TestRejectsNES2MapperMSB(t *testing.T) {
+	test_header := []uint8{0x4e, 0x45, 0x53, 0x1a, 0x01, 0x01, 0x00, 0x08, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	test_data := setupDataArray(test_header)
+	defer func() {
+		if recover() == nil {
+			t.Error("A mapper above 255 should be rejected")
+		}
+	}()
+	InitRom(test_data)
+}
+
+func TestCreatesCHRRamWithoutCHRRom(t *testing.T) {
+	test_header := []uint8{0x4e, 0x45, 0x53, 0x1a, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	test_data := setupDataArray(test_header)
+	actual := InitRom(test_data)
+	if !(len(actual.chr_rom) == CHR_RAM_SIZE && actual.HasCHRRam()) {
+		t.Error("A cartridge without CHR ROM should get 8KB of CHR RAM")
+	}
+}
+
+func TestReadsBatteryFlag(t *testing.T) {
+	test_header := []uint8{0x4e, 0x45, 0x53, 0x1a, 0x01, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	test_data := setupDataArray(test_header)
+	actual := InitRom(test_data)
+	if !(actual.battery) {
+		t.Error("Battery flag not read from the header")
+	}
+}
@@ -7,6 +7,9 @@ import (
 type AddressingMode uint8
 
 const STACK_RESET uint8 = 0xFD
+const RESET_CYCLES uint8 = 7
+const NMI_CYCLES uint8 = 7
+const IRQ_CYCLES uint8 = 7
 const PROGRAM_START uint16 = 0x8000
 
 const (
@@ -34,6 +37,39 @@ type OpCode struct {
 	f_call func(*CPU, OpCode)
 }
 
+func (o OpCode) Code() uint8 {
+	return o.code
+}
+
+func (o OpCode) Name() string {
+	return o.name
+}
+
+func (o OpCode) Mode() AddressingMode {
+	return o.mode
+}
+
+func (o OpCode) Cycles() uint8 {
+	return o.cycles
+}
+
+// Len is the number of bytes the instruction takes including the opcode,
+// it is derived from the addressing mode
+func (o OpCode) Len() uint8 {
+	return o.mode.Len()
+}
+
+func (m AddressingMode) Len() uint8 {
+	switch m {
+	case IMPLIED, ACCUMULATOR:
+		return 1
+	case ABSOLUTE, ABSOLUTEX, ABSOLUTEY, INDIRECT:
+		return 3
+	default:
+		return 2
+	}
+}
+
 // TODO: Check all the cycles and page crossing logic for opcodes
 
 var OPTABLE = map[uint8]OpCode{
@@ -277,6 +313,48 @@ var OPTABLE = map[uint8]OpCode{
 	0x02: {0x02, "HLT", IMPLIED, 2, 2, (*CPU).hlt},
 }
 
+// Memory is everything the CPU sees on its address and data lines. Tick is
+// called with the number of cycles each instruction took
+type Memory interface {
+	Read(addr uint16) uint8
+	Write(addr uint16, v uint8)
+	Tick(cycles uint8)
+}
+
+// Memories that can raise a non maskable interrupt implement nmiSource
+type nmiSource interface {
+	PollNMIStatus() *uint8
+}
+
+// Memories with devices on the IRQ line implement irqSource, the line is
+// level triggered and stays asserted until the device is acknowledged
+type irqSource interface {
+	IRQLine() bool
+}
+
+// Memories with devices that have a power-up and reset state implement
+// resetter, PowerOn and SoftReset pass them on
+type resetter interface {
+	PowerOn(pattern RamPattern, seed int64)
+	SoftReset()
+}
+
+// Memories with devices that must see a read on its own cycle implement
+// instructionTimer, they are told the instruction's length before the CPU
+// makes its accesses
+type instructionTimer interface {
+	BeginInstruction(cycles uint8)
+}
+
+type Variant uint8
+
+const (
+	// Ricoh 2A03 as found in the NES, decimal mode is wired off
+	RICOH_2A03 Variant = iota
+	// Original NMOS 6502 with BCD arithmetic in ADC and SBC
+	NMOS_6502
+)
+
 type CPU struct {
 	register_a      uint8
 	register_x      uint8
@@ -284,11 +362,22 @@ type CPU struct {
 	status          uint8
 	program_counter uint16
 	stack_pointer   uint8
-	Bus             *Bus
+	cycles          uint
+	variant         Variant
+	mem             Memory
+	Bus             *Bus // Only set when running on the NES bus
+	// CLI, SEI and PLP change I after the IRQ poll on their last cycle, so
+	// the poll before the next instruction sees the flag from before them
+	irq_mask_latched bool
+	irq_mask         bool
 }
 
 func (c *CPU) GetCycles() uint {
-	return c.Bus.cycles
+	if c.Bus != nil {
+		// The bus also counts cycles the CPU was stalled by DMA
+		return c.Bus.cycles
+	}
+	return c.cycles
 }
 
 func (c *CPU) ProgramCounter() uint16 {
@@ -315,8 +404,92 @@ func (c *CPU) GetStackPointer() uint8 {
 	return c.stack_pointer
 }
 
+// Registers is a snapshot of the programmer visible CPU state
+type Registers struct {
+	A  uint8
+	X  uint8
+	Y  uint8
+	P  uint8
+	SP uint8
+	PC uint16
+}
+
+func (c *CPU) Registers() Registers {
+	return Registers{A: c.register_a, X: c.register_x, Y: c.register_y, P: c.status, SP: c.stack_pointer, PC: c.program_counter}
+}
+
+func (c *CPU) SetRegisters(r Registers) {
+	c.register_a = r.A
+	c.register_x = r.X
+	c.register_y = r.Y
+	c.status = r.P
+	c.stack_pointer = r.SP
+	c.program_counter = r.PC
+}
+
 func InitCPU(b *Bus) *CPU {
-	return &CPU{Bus: b, stack_pointer: STACK_RESET, program_counter: 0x8000, status: 0b100100}
+	c := NewCPU(b, RICOH_2A03)
+	c.Bus = b
+	return c
+}
+
+// NewCPU creates a CPU of the given variant running on any memory, use
+// InitCPU for the NES
+func NewCPU(m Memory, v Variant) *CPU {
+	return &CPU{mem: m, variant: v, stack_pointer: STACK_RESET, program_counter: 0x8000, status: 0b100100}
+}
+
+func (c *CPU) beginInstruction(cycles uint8) {
+	if t, ok := c.mem.(instructionTimer); ok {
+		t.BeginInstruction(cycles)
+	}
+}
+
+func (c *CPU) tick(cycles uint8) {
+	c.cycles += uint(cycles)
+	c.mem.Tick(cycles)
+}
+
+func (c *CPU) pollNMI() bool {
+	if source, ok := c.mem.(nmiSource); ok {
+		return source.PollNMIStatus() != nil
+	}
+	return false
+}
+
+// IRQs are ignored while the interrupt disable flag is set
+func (c *CPU) pollIRQ() bool {
+	masked := c.status&0b0000_0100 != 0
+	if c.irq_mask_latched {
+		masked = c.irq_mask
+		c.irq_mask_latched = false
+	}
+	if masked {
+		return false
+	}
+	if source, ok := c.mem.(irqSource); ok {
+		return source.IRQLine()
+	}
+	return false
+}
+
+// latchIRQMask keeps the I flag from before opcode ran for the next IRQ
+// poll when the instruction is one that changes I late
+func (c *CPU) latchIRQMask(opcode uint8, status uint8) {
+	switch opcode {
+	case 0x58, 0x78, 0x28:
+		c.irq_mask_latched = true
+		c.irq_mask = status&0b0000_0100 != 0
+	}
+}
+
+// An NMI wins over an IRQ that is asserted at the same time
+func (c *CPU) handleInterrupts() {
+	if c.pollNMI() {
+		c.interrupt_nmi()
+	} else if c.pollIRQ() {
+		c.interrupt_irq()
+	}
 }
 
 func (c *CPU) LoadAndRun(program []uint8) {
@@ -335,24 +508,63 @@ func (c *CPU) Reset() {
 	c.stack_pointer = STACK_RESET
 }
 
+// PowerOn emulates turning the console on, the bus is put in its power-up
+// state with RAM filled by the given pattern before the reset sequence runs
+func (c *CPU) PowerOn(pattern RamPattern, seed int64) {
+	if r, ok := c.mem.(resetter); ok {
+		r.PowerOn(pattern, seed)
+	}
+	c.register_a = 0
+	c.register_x = 0
+	c.register_y = 0
+	c.status = 0b100000
+	c.stack_pointer = 0
+	c.resetSequence()
+}
+
+// PowerOnAt powers on and then starts executing at pc instead of the reset
+// vector, which is how nestest runs in automation mode
+func (c *CPU) PowerOnAt(pattern RamPattern, seed int64, pc uint16) {
+	c.PowerOn(pattern, seed)
+	c.program_counter = pc
+}
+
+// SoftReset emulates pressing the reset button, registers and RAM are
+// kept as they are
+func (c *CPU) SoftReset() {
+	if r, ok := c.mem.(resetter); ok {
+		r.SoftReset()
+	}
+	c.resetSequence()
+}
+
+func (c *CPU) resetSequence() {
+	// The reset sequence runs three stack pushes with writes suppressed
+	c.stack_pointer -= 3
+	c.set_interrupt_bit()
+	c.program_counter = c.MemRead16(0xFFFC)
+	c.tick(RESET_CYCLES)
+}
+
 func (c *CPU) RunWithCallback(f_call func()) {
 	var op OpCode
 	var ok bool
 	for {
-		if c.Bus.PollNMIStatus() != nil {
-			c.interrupt_nmi()
-		}
+		c.handleInterrupts()
 		f_call()
 		opcode := c.MemRead(c.program_counter)
 		c.program_counter++
 		if op, ok = OPTABLE[opcode]; !ok {
 			panic(fmt.Sprintf("No instr found for %x", opcode))
 		}
+		status := c.status
+		c.beginInstruction(op.cycles)
 		op.f_call(c, op)
 		if opcode == 0x00 || opcode == 0x02 {
 			return
 		}
-		c.Bus.Tick(op.cycles)
+		c.latchIRQMask(opcode, status)
+		c.tick(op.cycles)
 	}
 }
 
@@ -370,9 +582,7 @@ func (c *CPU) Load(program []uint8) {
 }
 
 func (c *CPU) Step(f_call func()) bool {
-	if c.Bus.PollNMIStatus() != nil {
-		c.interrupt_nmi()
-	}
+	c.handleInterrupts()
 	f_call()
 	opcode := c.MemRead(c.program_counter)
 	c.program_counter++
@@ -381,8 +591,11 @@ func (c *CPU) Step(f_call func()) bool {
 	if !ok {
 		panic(fmt.Sprintf("Unknown opcode: %x", opcode))
 	}
+	status := c.status
+	c.beginInstruction(op.cycles)
 	op.f_call(c, op)
-	c.Bus.Tick(op.cycles)
+	c.latchIRQMask(opcode, status)
+	c.tick(op.cycles)
 	return opcode != 0x00 && opcode != 0x02
 }
 
@@ -405,16 +618,26 @@ func (c *CPU) GetNextOpCode() (OpCode, uint16) {
 }
 
 func (c *CPU) interrupt_nmi() {
+	c.hardwareInterrupt(0xFFFA)
+	c.tick(NMI_CYCLES)
+}
+
+func (c *CPU) interrupt_irq() {
+	c.hardwareInterrupt(0xFFFE)
+	c.tick(IRQ_CYCLES)
+}
+
+// Unlike BRK the hardware interrupts push the status with B clear
+func (c *CPU) hardwareInterrupt(vector uint16) {
 	c.push_16(c.program_counter)
-	status := c.status | 0b0011_0000
+	status := (c.status | 0b0010_0000) &^ 0b0001_0000
 	c.push(status)
 	c.status |= 0b0000_0100
-	c.program_counter = c.MemRead16(0xFFFA)
-	c.Bus.Tick(2)
+	c.program_counter = c.MemRead16(vector)
 }
 
 func (c *CPU) push(val uint8) {
-	c.Bus.MemWrite(0x0100+uint16(c.stack_pointer), val)
+	c.mem.Write(0x0100+uint16(c.stack_pointer), val)
 	c.stack_pointer--
 }
 
@@ -444,16 +667,16 @@ func (c *CPU) doInterrupt(rd_addr uint16) {
 }
 
 func (c *CPU) MemRead(addr uint16) uint8 {
-	return c.Bus.MemRead(addr)
+	return c.mem.Read(addr)
 }
 
 func (c *CPU) MemWrite(addr uint16, v uint8) {
-	c.Bus.MemWrite(addr, v)
+	c.mem.Write(addr, v)
 }
 
 func (c *CPU) MemRead16(addr uint16) uint16 {
-	lo := c.Bus.MemRead(addr)
-	hi := c.Bus.MemRead(addr + 1)
+	lo := c.mem.Read(addr)
+	hi := c.mem.Read(addr + 1)
 	return make_16_bit(hi, lo)
 }
 
@@ -465,16 +688,16 @@ func (c *CPU) mem_read_16_zero(addr uint8) uint16 {
 func (c *CPU) MemWrite16(addr uint16, v uint16) {
 	lo := uint8(v & 0xFF)
 	hi := uint8(v >> 8)
-	c.Bus.MemWrite(addr, lo)
-	c.Bus.MemWrite(addr+1, hi)
+	c.mem.Write(addr, lo)
+	c.mem.Write(addr+1, hi)
 }
 
 func make_16_bit(hi, lo uint8) uint16 {
 	return (uint16(hi) << 8) | uint16(lo)
 }
 
-func (c *CPU) add_carry_bit(v uint8) uint8 {
-	return (c.status & 0b0000_0001) + v
+func (c *CPU) is_decimal_mode() bool {
+	return c.variant == NMOS_6502 && (c.status&0b0000_1000) > 0
 }
 
 func (c *CPU) is_carry_set() bool {
@@ -493,14 +716,6 @@ func (c *CPU) is_overflow_set() bool {
 	return (c.status & 0b0100_0000) > 0
 }
 
-func (c *CPU) decide_carry_bit(new_v, old_v uint8) {
-	if new_v < old_v {
-		c.set_carry_bit()
-	} else {
-		c.clear_carry_bit()
-	}
-}
-
 func (c *CPU) set_carry_bit() {
 	c.status |= 0b0000_0001
 }
@@ -666,7 +881,7 @@ func (c *CPU) cmp(op OpCode) {
 	c.program_counter++
 	c.do_compare(val, c.register_a)
 	if crossed {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 }
 
@@ -705,9 +920,9 @@ func (c *CPU) bne(op OpCode) {
 	if c.is_zero_set() {
 		return
 	}
-	c.Bus.Tick(1)
+	c.tick(1)
 	if c.will_pg_cross(addr) {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 	c.program_counter = addr
 }
@@ -723,9 +938,9 @@ func (c *CPU) bmi(op OpCode) {
 	if !c.is_negative_set() {
 		return
 	}
-	c.Bus.Tick(1)
+	c.tick(1)
 	if c.will_pg_cross(addr) {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 	c.program_counter = addr
 }
@@ -737,9 +952,9 @@ func (c *CPU) bvs(op OpCode) {
 	if !c.is_overflow_set() {
 		return
 	}
-	c.Bus.Tick(1)
+	c.tick(1)
 	if c.will_pg_cross(addr) {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 	c.program_counter = addr
 }
@@ -751,9 +966,9 @@ func (c *CPU) bpl(op OpCode) {
 	if c.is_negative_set() {
 		return
 	}
-	c.Bus.Tick(1)
+	c.tick(1)
 	if c.will_pg_cross(addr) {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 	c.program_counter = addr
 }
@@ -765,9 +980,9 @@ func (c *CPU) bvc(op OpCode) {
 	if c.is_overflow_set() {
 		return
 	}
-	c.Bus.Tick(1)
+	c.tick(1)
 	if c.will_pg_cross(addr) {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 	c.program_counter = addr
 }
@@ -784,7 +999,7 @@ func (c *CPU) and(op OpCode) {
 	crossed := false
 	c.do_and(c.interpret_mode(op.mode, nil, true, &crossed, false))
 	if crossed {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 }
 
@@ -800,7 +1015,7 @@ func (c *CPU) eor(op OpCode) {
 	c.program_counter++
 	c.set_zero_and_negative_flag(c.register_a)
 	if crossed {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 }
 
@@ -810,7 +1025,7 @@ func (c *CPU) ora(op OpCode) {
 	c.program_counter++
 	c.set_zero_and_negative_flag(c.register_a)
 	if crossed {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 }
 
@@ -819,7 +1034,7 @@ func (c *CPU) sbc(op OpCode) {
 	val := c.interpret_mode(op.mode, nil, true, &crossed, false)
 	c.do_sbc(val)
 	if crossed {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 }
 func (c *CPU) do_sbc(val uint8) {
@@ -828,6 +1043,11 @@ func (c *CPU) do_sbc(val uint8) {
 	// if carry=1 => borrowIn=0, if carry=0 => borrowIn=1.
 	// So we take the CPU’s carry bit and flip it.
 	old_a := c.register_a
+	if c.is_decimal_mode() {
+		c.do_decimal_sbc(val)
+		c.program_counter++
+		return
+	}
 	carry_bit := c.status & 0b00000001
 	borrow_in := uint16(1 - carry_bit) // 1 if carry=0, 0 if carry=1
 
@@ -977,7 +1197,7 @@ func (c *CPU) ign(op OpCode) {
 	c.interpret_mode(op.mode, nil, true, &crossed, true)
 	c.program_counter++
 	if crossed {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 }
 
@@ -1059,12 +1279,7 @@ func (c *CPU) rra(op OpCode) {
 	} else {
 		c.clear_carry_bit()
 	}
-	val = c.add_carry_bit(val)
-	result := val + c.register_a
-	c.decide_carry_bit(result, c.register_a)
-	c.compute_overflow_bit(val, c.register_a, result)
-	c.register_a = result
-	c.set_zero_and_negative_flag(c.register_a)
+	c.do_adc(val)
 	c.program_counter++
 }
 
@@ -1118,9 +1333,9 @@ func (c *CPU) bcc(op OpCode) {
 	if c.is_carry_set() {
 		return
 	}
-	c.Bus.Tick(1)
+	c.tick(1)
 	if c.will_pg_cross(addr) {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 	c.program_counter = addr
 }
@@ -1132,9 +1347,9 @@ func (c *CPU) bcs(op OpCode) {
 	if !c.is_carry_set() {
 		return
 	}
-	c.Bus.Tick(1)
+	c.tick(1)
 	if c.will_pg_cross(addr) {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 	c.program_counter = addr
 }
@@ -1146,31 +1361,96 @@ func (c *CPU) beq(op OpCode) {
 	if !c.is_zero_set() {
 		return
 	}
-	c.Bus.Tick(1)
+	c.tick(1)
 	if c.will_pg_cross(addr) {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 	c.program_counter = addr
 }
 
 func (c *CPU) adc(op OpCode) {
 	mem_val := c.interpret_mode(op.mode, nil, true, nil, false)
-	val := c.add_carry_bit(mem_val)
-	result := val + c.register_a
-	c.decide_carry_bit(result, c.register_a)
-	c.compute_overflow_bit(mem_val, c.register_a, result)
-	c.register_a = result
+	c.do_adc(mem_val)
 	c.program_counter++
+}
+
+func (c *CPU) do_adc(val uint8) {
+	if c.is_decimal_mode() {
+		c.do_decimal_adc(val)
+		return
+	}
+	sum := uint16(c.register_a) + uint16(val) + uint16(c.status&0b0000_0001)
+	result := uint8(sum)
+	if sum > 0xFF {
+		c.set_carry_bit()
+	} else {
+		c.clear_carry_bit()
+	}
+	c.compute_overflow_bit(val, c.register_a, result)
+	c.register_a = result
 	c.set_zero_and_negative_flag(c.register_a)
 }
 
+// On the NMOS 6502 the zero flag follows the binary sum, while N and V are
+// taken before the high nibble is adjusted
+func (c *CPU) do_decimal_adc(val uint8) {
+	a := c.register_a
+	carry := int(c.status & 0b0000_0001)
+	c.set_zero_flag(uint8(int(a) + int(val) + carry))
+	lo := int(a&0x0F) + int(val&0x0F) + carry
+	if lo > 0x09 {
+		lo += 0x06
+	}
+	hi := int(a>>4) + int(val>>4)
+	if lo > 0x0F {
+		hi++
+	}
+	partial := uint8(hi<<4 | lo&0x0F)
+	c.set_negative_flag(partial)
+	c.compute_overflow_bit(a, val, partial)
+	if hi > 0x09 {
+		hi += 0x06
+	}
+	if hi > 0x0F {
+		c.set_carry_bit()
+	} else {
+		c.clear_carry_bit()
+	}
+	c.register_a = uint8(hi<<4 | lo&0x0F)
+}
+
+// Decimal SBC sets all flags from the binary subtraction and only adjusts
+// the value stored in A
+func (c *CPU) do_decimal_sbc(val uint8) {
+	a := c.register_a
+	borrow := 1 - int(c.status&0b0000_0001)
+	temp := int(a) - int(val) - borrow
+	if temp >= 0 {
+		c.set_carry_bit()
+	} else {
+		c.clear_carry_bit()
+	}
+	c.compute_overflow_bit(a, ^val, uint8(temp))
+	c.set_zero_and_negative_flag(uint8(temp))
+	lo := int(a&0x0F) - int(val&0x0F) - borrow
+	hi := int(a>>4) - int(val>>4)
+	if lo < 0 {
+		lo -= 0x06
+		hi--
+	}
+	if hi < 0 {
+		hi -= 0x06
+	}
+	c.register_a = uint8(hi<<4 | lo&0x0F)
+}
+
 func (c *CPU) lda(op OpCode) {
 	crossed := false
 	c.register_a = c.interpret_mode(op.mode, nil, true, &crossed, false)
 	c.program_counter++
 	c.set_zero_and_negative_flag(c.register_a)
 	if crossed {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 }
 
@@ -1180,7 +1460,7 @@ func (c *CPU) ldy(op OpCode) {
 	c.program_counter++
 	c.set_zero_and_negative_flag(c.register_y)
 	if crossed {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 }
 
@@ -1190,7 +1470,7 @@ func (c *CPU) ldx(op OpCode) {
 	c.program_counter++
 	c.set_zero_and_negative_flag(c.register_x)
 	if crossed {
-		c.Bus.Tick(1)
+		c.tick(1)
 	}
 }
 
@@ -2599,3 +2599,228 @@ func TestFiveOpsWorkingTogether(t *testing.T) {
 	assert_register(t, c.register_x, 0xc1)
 	assert_status(t, c.status, 0b1000_0100)
 }
+
+// Power on and reset
+func TestPowerOnSetsInitialState(t *testing.T) {
+	vec := []uint8{0x00}
+	c := InitCPU(setupTestBus(vec))
+	c.register_a = 0x25
+	c.PowerOn(RAM_ZEROS, 0)
+	assert_register(t, c.register_a, 0x00)
+	assert_register(t, c.stack_pointer, 0xFD)
+	assert_status(t, c.status, 0b0010_0100)
+	if !(c.program_counter == 0x8000) {
+		t.Errorf("Program counter not loaded from reset vector, got %x", c.program_counter)
+	}
+	if !(c.GetCycles() == 7) {
+		t.Errorf("Reset sequence should take 7 cycles, got %d", c.GetCycles())
+	}
+}
+
+func TestSoftResetKeepsRegistersAndRam(t *testing.T) {
+	vec := []uint8{0x00}
+	c := InitCPU(setupTestBus(vec))
+	c.PowerOn(RAM_ZEROS, 0)
+	c.register_a = 0x25
+	c.stack_pointer = 0xF0
+	c.status = 0b0010_0000
+	c.MemWrite(0x0010, 0x15)
+	c.SoftReset()
+	assert_register(t, c.register_a, 0x25)
+	assert_register(t, c.stack_pointer, 0xED)
+	assert_status(t, c.status, 0b0010_0100)
+	assert_register(t, c.MemRead(0x0010), 0x15)
+	if !(c.GetCycles() == 14) {
+		t.Errorf("Soft reset should keep counting cycles, got %d", c.GetCycles())
+	}
+}
+
+// Decimal mode
+type flatMemory struct {
+	data   [0x10000]uint8
+	cycles uint
+}
+
+func (m *flatMemory) Read(addr uint16) uint8 {
+	return m.data[addr]
+}
+
+func (m *flatMemory) Write(addr uint16, v uint8) {
+	m.data[addr] = v
+}
+
+func (m *flatMemory) Tick(cycles uint8) {
+	m.cycles += uint(cycles)
+}
+
+func setupFlatCPU(program []uint8, v Variant) *CPU {
+	m := &flatMemory{}
+	copy(m.data[0x8000:], program)
+	c := NewCPU(m, v)
+	c.program_counter = 0x8000
+	return c
+}
+
+func TestRunsOnFlatMemory(t *testing.T) {
+	vec := []uint8{0xa9, 0x05, 0x85, 0x10, 0x00}
+	c := setupFlatCPU(vec, RICOH_2A03)
+	c.Run()
+	assert_register(t, c.MemRead(0x0010), 0x05)
+	if !(c.GetCycles() == 5) {
+		t.Errorf("Cycles not counted on flat memory, got %d", c.GetCycles())
+	}
+}
+
+func TestResetOnFlatMemory(t *testing.T) {
+	c := setupFlatCPU([]uint8{}, NMOS_6502)
+	c.MemWrite16(0xFFFC, 0x9000)
+	c.PowerOn(RAM_ZEROS, 0)
+	if !(c.program_counter == 0x9000) {
+		t.Errorf("Power on should jump to the reset vector, got %04X", c.program_counter)
+	}
+	c.program_counter = 0x8000
+	c.SoftReset()
+	if !(c.program_counter == 0x9000 && c.status&0b0000_0100 != 0) {
+		t.Error("Soft reset should run the reset sequence without a bus")
+	}
+}
+
+func TestADCDecimalMode(t *testing.T) {
+	// SED, CLC, LDA #$15, ADC #$27
+	vec := []uint8{0xf8, 0x18, 0xa9, 0x15, 0x69, 0x27, 0x00}
+	c := setupFlatCPU(vec, NMOS_6502)
+	c.Run()
+	assert_register(t, c.register_a, 0x42)
+	if c.is_carry_set() {
+		t.Error("Carry should not be set")
+	}
+}
+
+func TestADCDecimalModeCarry(t *testing.T) {
+	// SED, SEC, LDA #$99, ADC #$01
+	vec := []uint8{0xf8, 0x38, 0xa9, 0x99, 0x69, 0x01, 0x00}
+	c := setupFlatCPU(vec, NMOS_6502)
+	c.Run()
+	assert_register(t, c.register_a, 0x01)
+	if !c.is_carry_set() {
+		t.Error("Carry should be set")
+	}
+}
+
+func TestSBCDecimalMode(t *testing.T) {
+	// SED, SEC, LDA #$42, SBC #$15
+	vec := []uint8{0xf8, 0x38, 0xa9, 0x42, 0xe9, 0x15, 0x00}
+	c := setupFlatCPU(vec, NMOS_6502)
+	c.Run()
+	assert_register(t, c.register_a, 0x27)
+	if !c.is_carry_set() {
+		t.Error("Carry should be set")
+	}
+}
+
+func TestSBCDecimalModeBorrow(t *testing.T) {
+	// SED, SEC, LDA #$00, SBC #$01
+	vec := []uint8{0xf8, 0x38, 0xa9, 0x00, 0xe9, 0x01, 0x00}
+	c := setupFlatCPU(vec, NMOS_6502)
+	c.Run()
+	assert_register(t, c.register_a, 0x99)
+	if c.is_carry_set() {
+		t.Error("Carry should not be set")
+	}
+}
+
+func TestADCIgnoresDecimalOn2A03(t *testing.T) {
+	// SED, CLC, LDA #$15, ADC #$27
+	vec := []uint8{0xf8, 0x18, 0xa9, 0x15, 0x69, 0x27, 0x00}
+	c := setupFlatCPU(vec, RICOH_2A03)
+	c.Run()
+	assert_register(t, c.register_a, 0x3C)
+}
+
+func TestADCCarryWhenOperandAndCarryWrap(t *testing.T) {
+	// SEC, LDA #$10, ADC #$FF
+	vec := []uint8{0x38, 0xa9, 0x10, 0x69, 0xff, 0x00}
+	c := setupFlatCPU(vec, RICOH_2A03)
+	c.Run()
+	assert_register(t, c.register_a, 0x10)
+	if !c.is_carry_set() {
+		t.Error("Carry should be set")
+	}
+}
+
+func TestNMIAfterEnablingInVblank(t *testing.T) {
+	// LDA #$80, STA $2000, NOP, NOP with the NMI handler at $8010
+	vec := []uint8{0xA9, 0x80, 0x8D, 0x00, 0x20, 0xEA, 0xEA}
+	b := setupTestBus(vec)
+	b.rom.prg_rom[0x7FFA] = 0x10
+	b.rom.prg_rom[0x7FFB] = 0x80
+	b.rom.prg_rom[0x10] = 0xEA
+	c := InitCPU(b)
+	c.Reset()
+	b.ppu.status.setVblank()
+	c.Step(func() {})
+	c.Step(func() {})
+	c.Step(func() {})
+	if !(c.program_counter == 0x8006) {
+		t.Errorf("NMI should wait for the instruction after the write, PC is %04X", c.program_counter)
+	}
+	cycles := b.cycles
+	c.Step(func() {})
+	if !(c.program_counter == 0x8011 && b.cycles-cycles == 7+2) {
+		t.Errorf("NMI not taken in 7 cycles, PC is %04X after %d cycles", c.program_counter, b.cycles-cycles)
+	}
+	if !(b.cpu_vram[0x1FD] == 0x80 && b.cpu_vram[0x1FC] == 0x06 && b.cpu_vram[0x1FB]&0b0011_0000 == 0b0010_0000) {
+		t.Error("NMI should push the return address and the status with B clear")
+	}
+}
+
+func TestIRQTakenAfterSEI(t *testing.T) {
+	// CLI, SEI, NOP with the IRQ handler at $8010
+	vec := []uint8{0x58, 0x78, 0xEA}
+	b := setupTestBus(vec)
+	b.rom.prg_rom[0x7FFE] = 0x10
+	b.rom.prg_rom[0x7FFF] = 0x80
+	b.rom.prg_rom[0x10] = 0xEA
+	c := InitCPU(b)
+	c.Reset()
+	c.Step(func() {})
+	b.apu.dmc.irq = true
+	c.Step(func() {})
+	c.Step(func() {})
+	if !(c.program_counter == 0x8011 && b.cpu_vram[0x1FC] == 0x02) {
+		t.Errorf("An IRQ pending during SEI should still be taken once, PC is %04X", c.program_counter)
+	}
+	if !(b.cpu_vram[0x1FB]&0b0000_0100 != 0) {
+		t.Error("The pushed status should have I set by SEI")
+	}
+}
+
+func TestIRQTakenOnlyWithInterruptsEnabled(t *testing.T) {
+	// SEI, NOP, CLI, NOP with the IRQ handler at $8010
+	vec := []uint8{0x78, 0xEA, 0x58, 0xEA}
+	b := setupTestBus(vec)
+	b.rom.prg_rom[0x7FFE] = 0x10
+	b.rom.prg_rom[0x7FFF] = 0x80
+	b.rom.prg_rom[0x10] = 0xEA
+	c := InitCPU(b)
+	c.Reset()
+	b.apu.dmc.irq = true
+	c.Step(func() {})
+	c.Step(func() {})
+	c.Step(func() {})
+	if !(c.program_counter == 0x8003) {
+		t.Errorf("IRQ should be masked while I is set, PC is %04X", c.program_counter)
+	}
+	// The instruction after CLI still runs before the IRQ
+	c.Step(func() {})
+	if !(c.program_counter == 0x8004) {
+		t.Errorf("IRQ should wait one instruction after CLI, PC is %04X", c.program_counter)
+	}
+	c.Step(func() {})
+	if !(c.program_counter == 0x8011) {
+		t.Errorf("IRQ not taken, PC is %04X", c.program_counter)
+	}
+	if !(b.cpu_vram[0x1FD] == 0x80 && b.cpu_vram[0x1FC] == 0x04 && b.cpu_vram[0x1FB]&0b0011_0100 == 0b0010_0000) {
+		t.Error("IRQ should push the return address and the status with B and I clear")
+	}
+}
@@ -23,6 +23,11 @@ func NewJoypad() *Joypad {
 	return &Joypad{}
 }
 
+func (j *Joypad) reset() {
+	j.strobe = false
+	j.button_idx = 0
+}
+
 func (j *Joypad) WriteData(v uint8) {
 	j.strobe = v&1 == 1
 	if j.strobe {
@@ -1,40 +1,164 @@
 package cpu
 
+// The console has 2KB of nametable memory, four screen cartridges add 2KB
+// more so every nametable has its own
+const VRAM_SIZE = 4096
+
+// Nametables lets a cartridge serve $2000-$2FFF itself, for mappers that
+// back nametables with ROM or their own RAM instead of the PPU's VRAM
+type Nametables interface {
+	ReadNametable(addr uint16) uint8
+	WriteNametable(addr uint16, v uint8)
+}
+
+// The CPU samples its NMI input once per cycle, an edge that has not lasted
+// this many dots can still be taken back
+const NMI_DETECT_DOTS = 3
+
 type PPU struct {
 	chr_rom       []uint8
+	chr_writable  bool // the pattern tables are CHR RAM
 	palette_table [32]uint8
-	vram          [2048]uint8
+	vram          [VRAM_SIZE]uint8 // console VRAM, then the cartridge's for four screen
 	oam_data      [256]uint8
 	oam_addr_reg  uint8
 	mirroring     Mirroring
-	addr          *AddressRegister
+	nametables    Nametables
 	ctrl          *ControlRegister
 	mask          *MaskRegister
 	status        *StatusRegister
-	scroll        *ScrollRegister
+	v             uint16 // current VRAM address, also the scroll position while rendering
+	t             uint16 // VRAM address of the top left tile, copied into v
+	fine_x        uint8
+	w             bool // write toggle shared by $2005 and $2006
 	data_buffer   uint8
+	io_latch      uint8 // PPU side data bus, read back for bits no register drives
 	cycles        uint32
 	scanline      uint32
-	nmi_interrupt *uint8
+	timing        Timing
+	odd_frame     bool
+	warmup        uint32 // dots left until register writes are accepted
+	nmi_line      bool   // vblank and NMI enabled, the level the CPU sees
+	nmi_pending   bool   // a rising edge of nmi_line the CPU has not taken yet
+	nmi_age       uint32 // dots since the pending edge
+	nmi_late      bool   // the edge came from a write on the last cycle of an instruction
+	vbl_suppress  bool   // $2002 was read just before vblank, the flag is not set this frame
+	frame         *Frame
+	render_mode   RenderMode
+	bg_next_tile  uint8
+	bg_next_attr  uint8
+	bg_next_lo    uint8
+	bg_next_hi    uint8
+	bg_shift_lo   uint16
+	bg_shift_hi   uint16
+	bg_attr_lo    uint16
+	bg_attr_hi    uint16
+	line_sprites  []lineSprite
+	// Draw every sprite on a line instead of the first eight, overflow is
+	// still reported like the hardware does
+	no_sprite_limit bool
 }
 
 func NewPPU(chr_rom []uint8, mirroring Mirroring) *PPU {
 	return &PPU{
 		chr_rom:       chr_rom,
 		palette_table: [32]uint8{},
-		vram:          [2048]uint8{},
+		vram:          [VRAM_SIZE]uint8{},
 		oam_data:      [256]uint8{},
 		mirroring:     mirroring,
-		addr:          NewAddressRegister(),
 		ctrl:          NewControlRegister(),
 		mask:          NewMaskRegister(),
 		status:        NewStatusRegister(),
-		scroll:        NewScrollRegister(),
+		frame:         NewFrame(),
+		timing:        REGION_NTSC.Timing(),
+		line_sprites:  make([]lineSprite, 0, 64),
 	}
 }
 
+// Frame is the picture the PPU draws into, it holds a finished frame when
+// the frame callback runs
+func (p *PPU) Frame() *Frame {
+	return p.frame
+}
+
+func (p *PPU) SetRenderMode(m RenderMode) {
+	p.render_mode = m
+}
+
+func (p *PPU) SetRegion(r Region) {
+	p.timing = r.Timing()
+}
+
+// After power on the PPU ignores writes to $2000, $2001, $2005 and $2006
+// until the first pre-render line, counted here in dots
+func (p *PPU) warmupDots() uint32 {
+	return uint32(p.timing.WarmupCycles * p.timing.DotsPerCycle / p.timing.DotsPerCycleDiv)
+}
+
+// The pre-render line is the last of the frame
+func (p *PPU) preRenderLine() uint32 {
+	return p.timing.Scanlines - 1
+}
+
+// SetNametables hands nametable accesses to n, nil goes back to VRAM with
+// the mirroring from the cartridge header
+func (p *PPU) SetNametables(n Nametables) {
+	p.nametables = n
+}
+
+func (p *PPU) SetCHRWritable(on bool) {
+	p.chr_writable = on
+}
+
+func (p *PPU) SetNoSpriteLimit(on bool) {
+	p.no_sprite_limit = on
+}
+
+// PowerOn clears all registers and memory owned by the PPU
+func (p *PPU) PowerOn() {
+	p.palette_table = [32]uint8{}
+	p.vram = [VRAM_SIZE]uint8{}
+	p.oam_data = [256]uint8{}
+	p.oam_addr_reg = 0
+	p.v = 0
+	p.status = NewStatusRegister()
+	p.SoftReset()
+}
+
+// SoftReset clears the control, mask and scroll state and restarts the
+// frame, while status, OAM and VRAM keep their contents. The reset line
+// also starts the warm-up again
+func (p *PPU) SoftReset() {
+	p.warmup = p.warmupDots()
+	p.ctrl = NewControlRegister()
+	p.mask = NewMaskRegister()
+	p.t = 0
+	p.fine_x = 0
+	p.w = false
+	p.data_buffer = 0
+	p.io_latch = 0
+	p.cycles = 0
+	p.scanline = 0
+	p.odd_frame = false
+	p.nmi_line = false
+	p.nmi_pending = false
+	p.nmi_late = false
+	p.vbl_suppress = false
+}
+
+// The first write sets the high six bits of t, the second the low byte and
+// then copies t into v
 func (p *PPU) WriteToPPUAddr(v uint8) {
-	p.addr.Update(v)
+	if p.warmup > 0 {
+		return
+	}
+	if !p.w {
+		p.t = (p.t & 0x00FF) | uint16(v&0x3F)<<8
+	} else {
+		p.t = (p.t & 0xFF00) | uint16(v)
+		p.v = p.t
+	}
+	p.w = !p.w
 }
 
 func (p *PPU) WriteToOAMAddr(v uint8) {
@@ -42,49 +166,118 @@ func (p *PPU) WriteToOAMAddr(v uint8) {
 }
 
 func (p *PPU) Tick(cycles uint8) bool {
-	p.cycles += uint32(cycles)
-	if p.cycles >= 341 {
-		p.cycles -= 341
-		p.scanline += 1
-		if p.scanline == 241 {
+	newFrame := false
+	for i := uint8(0); i < cycles; i++ {
+		if p.tickDot() {
+			newFrame = true
+		}
+	}
+	return newFrame
+}
+
+func (p *PPU) tickDot() bool {
+	if p.warmup > 0 {
+		p.warmup--
+	}
+	if p.scanline == p.timing.VblankLine && p.cycles == 1 {
+		if !p.vbl_suppress {
 			p.status.setVblank()
-			p.status.clearSprite0Flag()
-			if p.ctrl.GenerateVBlankNMI() {
-				var v uint8 = 1
-				p.nmi_interrupt = &v
-			}
+			p.updateNMI(false)
 		}
-		if p.scanline >= 262 {
+		p.vbl_suppress = false
+	}
+	if p.scanline == p.preRenderLine() && p.cycles == 1 {
+		p.status.resetVblank()
+		p.status.clearSprite0Flag()
+		p.status.clearSpriteOverflow()
+		p.updateNMI(false)
+	}
+	if p.nmi_pending {
+		p.nmi_age++
+	}
+	if p.render_mode == RENDER_DOTS && (p.scanline < HEIGHT || p.scanline == p.preRenderLine()) {
+		p.renderDot()
+	} else if p.render_mode == RENDER_FRAME {
+		p.approximateSprite0Hit()
+		// Only for the overflow flag, the frame renderer applies the
+		// limit itself
+		if p.cycles == 257 && p.isRenderingEnabled() {
+			p.evaluateSprites()
+		}
+	}
+	p.cycles++
+	if p.scanline == p.preRenderLine() && p.cycles == DOTS_PER_SCANLINE-1 && p.odd_frame && p.timing.OddFrameSkip && p.isRenderingEnabled() {
+		// Odd NTSC frames skip the last dot of the pre-render line
+		p.cycles++
+	}
+	if p.cycles >= DOTS_PER_SCANLINE {
+		p.cycles -= DOTS_PER_SCANLINE
+		p.scanline += 1
+		if p.scanline > p.preRenderLine() {
 			p.scanline = 0
-			p.nmi_interrupt = nil
-			p.status.clearSprite0Flag()
-			p.status.resetVblank()
+			p.odd_frame = !p.odd_frame
+			if p.render_mode == RENDER_FRAME {
+				p.frame.Render(p)
+			}
 			return true
 		}
 	}
 	return false
 }
 
+// PollNMIStatus is asked by the CPU between instructions. The CPU polls
+// before the last cycle of an instruction, so an edge during that cycle, or
+// from a register write done in it, is only taken after the next one
 func (p *PPU) PollNMIStatus() *uint8 {
-	if p.nmi_interrupt != nil {
-		ret := *p.nmi_interrupt
-		p.nmi_interrupt = nil
-		return &ret
+	if !p.nmi_pending || p.nmi_age < NMI_DETECT_DOTS {
+		return nil
+	}
+	if p.nmi_late {
+		p.nmi_late = false
+		return nil
+	}
+	p.nmi_pending = false
+	var v uint8 = 1
+	return &v
+}
+
+// updateNMI follows the NMI line after vblank or the NMI enable changed.
+// NMI is edge triggered, so every rising edge raises one, even a second
+// time in the same vblank. A line that drops again before the CPU sampled
+// it raises none
+func (p *PPU) updateNMI(fromWrite bool) {
+	line := p.status.isVblankSet() && p.ctrl.GenerateVBlankNMI()
+	if line && !p.nmi_line {
+		p.nmi_pending = true
+		p.nmi_age = 0
+		p.nmi_late = fromWrite
+	} else if !line && p.nmi_line && p.nmi_pending && p.nmi_age < NMI_DETECT_DOTS {
+		p.nmi_pending = false
 	}
-	return nil
+	p.nmi_line = line
 }
 
 func (p *PPU) WriteToPPUCtrl(v uint8) {
-	before_nmi_status := p.ctrl.GenerateVBlankNMI()
-	p.ctrl.Update(v)
-	if !before_nmi_status && p.ctrl.GenerateVBlankNMI() && p.status.isVblankSet() {
-		var val uint8 = 1
-		p.nmi_interrupt = &val
+	if p.warmup > 0 {
+		return
 	}
+	p.ctrl.Update(v)
+	p.t = (p.t &^ 0x0C00) | uint16(v&0b11)<<10
+	p.updateNMI(true)
 }
 
+// The first write sets coarse and fine x, the second coarse and fine y
 func (p *PPU) WriteToScroll(v uint8) {
-	p.scroll.write(v)
+	if p.warmup > 0 {
+		return
+	}
+	if !p.w {
+		p.t = (p.t &^ 0x001F) | uint16(v>>3)
+		p.fine_x = v & 0b111
+	} else {
+		p.t = (p.t &^ 0x73E0) | uint16(v&0b111)<<12 | uint16(v>>3)<<5
+	}
+	p.w = !p.w
 }
 
 func (p *PPU) WriteToOAMDMA(data *[256]uint8) {
@@ -94,56 +287,97 @@ func (p *PPU) WriteToOAMDMA(data *[256]uint8) {
 	}
 }
 
+// Only the top three bits of status are driven, the rest come from the
+// latch. A read on the dot before vblank starts sees it clear and keeps it
+// from being set this frame, a read right after it starts clears it before
+// the NMI is seen
 func (p *PPU) ReadStatusRegister() uint8 {
-	val := p.status.value
+	if p.scanline == p.timing.VblankLine && p.cycles == 1 {
+		p.vbl_suppress = true
+	}
+	val := p.status.value&0b1110_0000 | p.io_latch&0b0001_1111
 	p.status.resetVblank()
-	p.addr.reset_latch()
-	p.scroll.resetLatch()
+	p.updateNMI(false)
+	p.w = false
+	p.io_latch = val
 	return val
 }
 
+// While rendering, a $2007 access bumps coarse x and y like the fetch
+// pipeline does instead of adding the increment
 func (p *PPU) incrVramAddr() {
-	p.addr.increment(p.ctrl.VramAddIncrement())
+	if p.isRenderingEnabled() && (p.scanline < HEIGHT || p.scanline == p.preRenderLine()) {
+		p.incrementX()
+		p.incrementY()
+		return
+	}
+	p.v = (p.v + uint16(p.ctrl.VramAddIncrement())) & 0x7FFF
 }
 
 func (p *PPU) WriteToData(v uint8) {
-	addr := p.addr.get()
-	if addr >= 0 && addr <= 0x1FFF {
-		panic("Attempt to write to chr rom space")
-	} else if addr >= 0x2000 && addr <= 0x2FFF {
-		p.vram[p.mirrorVramAddr(addr)] = v
-	} else if addr >= 0x3000 && addr <= 0x3EFF {
-		panic("0x3000 to 0x3EFF shouldnt be used")
-	} else if addr == 0x3F10 || addr == 0x3F14 ||
-		addr == 0x3F18 || addr == 0x3F1C {
-		addr_mirr := addr - 0x10
-		p.palette_table[addr_mirr-0x3F00] = v
-	} else if addr >= 0x3F00 && addr <= 0x3FFF {
-		p.palette_table[addr-0x3F00] = v
-	} else {
-		panic("Invalid address passed")
+	addr := p.v & 0x3FFF
+	// CHR ROM ignores writes, CHR RAM takes them
+	if addr <= 0x1FFF && p.chr_writable {
+		p.chr_rom[addr] = v
+	} else if addr >= 0x2000 && addr <= 0x3EFF {
+		p.writeNametable(addr, v)
+	} else if addr >= 0x3F00 {
+		p.palette_table[paletteIndex(uint8(addr))] = v & 0x3F
 	}
 	p.incrVramAddr()
 }
 
+// Reads below the palette return the buffered byte and refill the buffer.
+// Palette reads are immediate, the buffer is still refilled with the
+// nametable byte underneath and the top two bits come from the latch
 func (p *PPU) ReadData() uint8 {
-	addr := p.addr.get()
+	addr := p.v & 0x3FFF
 	p.incrVramAddr()
+	var ret uint8
+	if addr >= 0x3F00 {
+		ret = p.readPalette(uint8(addr)) | p.io_latch&0b1100_0000
+		p.data_buffer = p.readNametable(addr)
+	} else {
+		ret = p.data_buffer
+		p.data_buffer = p.readVram(addr)
+	}
+	p.io_latch = ret
+	return ret
+}
+
+// OpenBus is what reading a write only register returns
+func (p *PPU) OpenBus() uint8 {
+	return p.io_latch
+}
+
+// WriteToRegister records a CPU write to any PPU register on the latch
+func (p *PPU) WriteToRegister(v uint8) {
+	p.io_latch = v
+}
+
+// readVram is a read on the PPU's own bus as done by the rendering
+// pipeline, it has no side effects
+func (p *PPU) readVram(addr uint16) uint8 {
+	addr &= 0x3FFF
+	if addr <= 0x1FFF {
+		return p.chr_rom[addr]
+	} else if addr <= 0x3EFF {
+		return p.readNametable(addr)
+	}
+	return p.readPalette(uint8(addr))
+}
+
+func (p *PPU) readPalette(idx uint8) uint8 {
+	return p.palette_table[paletteIndex(idx)]
+}
 
-	if addr >= 0x0000 && addr <= 0x1FFF {
-		ret := p.data_buffer
-		p.data_buffer = p.chr_rom[addr]
-		return ret
-	} else if addr >= 0x2000 && addr <= 0x2FFF {
-		ret := p.data_buffer
-		p.data_buffer = p.vram[p.mirrorVramAddr(addr)]
-		return ret
-	} else if addr >= 0x3000 && addr <= 0x3EFF {
-		panic("Space 0x3000 to 0x3EFF is not expected to be used")
-	} else if addr >= 0x3F00 && addr <= 0x3FFF {
-		return p.palette_table[(addr - 0x3F00)]
+// Entry 0 of each sprite palette mirrors the matching background entry
+func paletteIndex(idx uint8) uint8 {
+	idx &= 0x1F
+	if idx&0x13 == 0x10 {
+		idx &^= 0x10
 	}
-	panic("Unexpected access to mirrored space")
+	return idx
 }
 
 func (p *PPU) WriteOAMData(v uint8) {
@@ -152,13 +386,32 @@ func (p *PPU) WriteOAMData(v uint8) {
 }
 
 func (p *PPU) ReadOAMData() uint8 {
-	return p.oam_data[p.oam_addr_reg]
+	p.io_latch = p.oam_data[p.oam_addr_reg]
+	return p.io_latch
 }
 
 func (p *PPU) WriteToMask(v uint8) {
+	if p.warmup > 0 {
+		return
+	}
 	p.mask.update(v)
 }
 
+func (p *PPU) readNametable(addr uint16) uint8 {
+	if p.nametables != nil {
+		return p.nametables.ReadNametable(0x2000 | addr&0x0FFF)
+	}
+	return p.vram[p.mirrorVramAddr(addr)]
+}
+
+func (p *PPU) writeNametable(addr uint16, v uint8) {
+	if p.nametables != nil {
+		p.nametables.WriteNametable(0x2000|addr&0x0FFF, v)
+		return
+	}
+	p.vram[p.mirrorVramAddr(addr)] = v
+}
+
 func (p *PPU) mirrorVramAddr(addr uint16) uint16 {
 	/*
 			There exists 1kb of vram in address 0x0000 to 0x400
@@ -174,6 +427,9 @@ func (p *PPU) mirrorVramAddr(addr uint16) uint16 {
 			VERTICAL:
 			[A, B]
 			[a, b]
+			FOUR_SCREEN:
+			[A, B]
+			[C, D]
 
 			This allows either smooth horizontal scrolling when using vertical mapping or
 			smooth vertical scrolling when using horizontal mapping
@@ -193,56 +449,6 @@ func (p *PPU) mirrorVramAddr(addr uint16) uint16 {
 	return vram_idx
 }
 
-type AddressRegister struct {
-	value [2]uint8 // First entry is high byte
-	is_hi bool
-}
-
-func NewAddressRegister() *AddressRegister {
-	return &AddressRegister{
-		is_hi: true,
-		value: [2]uint8{},
-	}
-}
-
-func (a *AddressRegister) set(v uint16) {
-	hi := uint8(v >> 8)
-	lo := uint8(v & 0xFF)
-	a.value[0] = hi
-	a.value[1] = lo
-}
-
-func (a *AddressRegister) Update(v uint8) {
-	if a.is_hi {
-		a.value[0] = v
-	} else {
-		a.value[1] = v
-	}
-	if a.get() > 0x3FFF {
-		a.set(a.get() & 0b11111111111111)
-	}
-	a.is_hi = !a.is_hi
-}
-
-func (a *AddressRegister) get() uint16 {
-	return (uint16(a.value[1]) | (uint16(a.value[0]) << 8))
-}
-
-func (a *AddressRegister) increment(inc uint8) {
-	lo := a.value[1]
-	a.value[1] += inc
-	if lo > a.value[1] {
-		a.value[0]++
-	}
-	if a.get() > 0x3FFF {
-		a.set(a.get() & 0b11111111111111)
-	}
-}
-
-func (a *AddressRegister) reset_latch() {
-	a.is_hi = true
-}
-
 type ControlRegister struct {
 	value uint8
 }
@@ -274,6 +480,14 @@ func (c *ControlRegister) BnkdPatternAddress() uint16 {
 	}
 }
 
+func (c *ControlRegister) SpriteHeight() uint8 {
+	if (c.value & 0b0010_0000) == 0 {
+		return 8
+	} else {
+		return 16
+	}
+}
+
 func (c *ControlRegister) SprtPatternAddress() uint16 {
 	if (c.value & 0b0000_1000) == 0 {
 		return 0
@@ -348,6 +562,10 @@ func (m *StatusRegister) setSprite0Flag() {
 	m.value |= 0b0100_0000
 }
 
+func (m *StatusRegister) isSprite0HitSet() bool {
+	return (m.value & 0b0100_0000) > 0
+}
+
 func (m *StatusRegister) clearSprite0Flag() {
 	m.value &= 0b1011_1111
 }
@@ -356,25 +574,10 @@ func (m *StatusRegister) setSpriteOverflow() {
 	m.value |= 0b0010_0000
 }
 
-type ScrollRegister struct {
-	x_value uint8
-	y_value uint8
-	is_x    bool
-}
-
-func NewScrollRegister() *ScrollRegister {
-	return &ScrollRegister{x_value: 0, y_value: 0, is_x: true}
-}
-
-func (s *ScrollRegister) write(v uint8) {
-	if s.is_x {
-		s.x_value = v
-	} else {
-		s.y_value = v
-	}
-	s.is_x = !s.is_x
+func (m *StatusRegister) isSpriteOverflowSet() bool {
+	return (m.value & 0b0010_0000) > 0
 }
 
-func (s *ScrollRegister) resetLatch() {
-	s.is_x = true
+func (m *StatusRegister) clearSpriteOverflow() {
+	m.value &= 0b1101_1111
 }
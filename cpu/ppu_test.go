@@ -11,7 +11,7 @@ func TestWritesValueToPPUAddr(t *testing.T) {
 	p := setupTestPPU(VERTICAL)
 	p.WriteToPPUAddr(0x21)
 	p.WriteToPPUAddr(0x15)
-	if !(p.addr.get() == 0x2115) {
+	if !(p.v == 0x2115) {
 		t.Error("PPU addr not correct")
 	}
 }
@@ -122,8 +122,8 @@ func TestWritesToPPUCtrl(t *testing.T) {
 func TestWritesToScrollInXMode(t *testing.T) {
 	p := setupTestPPU(VERTICAL)
 	p.WriteToScroll(0x25)
-	if !(p.scroll.x_value == 0x25) {
-		t.Error("Scroll x_value not correct")
+	if !(p.t == 0x0004 && p.fine_x == 0x05 && p.w) {
+		t.Error("Scroll x not correct")
 	}
 }
 
@@ -131,17 +131,41 @@ func TestWritesToScrollInYMode(t *testing.T) {
 	p := setupTestPPU(VERTICAL)
 	p.WriteToScroll(0x15)
 	p.WriteToScroll(0x25)
-	if !(p.scroll.x_value == 0x15 && p.scroll.y_value == 0x25) {
+	// Coarse y 4 and fine y 5 from $25 on top of coarse x 2 from $15
+	if !(p.t == 0x5082 && p.fine_x == 0x05 && !p.w) {
 		t.Error("Scroll values not correct")
 	}
 }
+
+func TestScrollAndAddrShareWriteToggle(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	p.WriteToScroll(0x7D)
+	p.WriteToPPUAddr(0x21)
+	if !(p.t == 0x0021 && p.v == 0x0021) {
+		t.Errorf("Expected the second write to complete the address, t=%04X v=%04X", p.t, p.v)
+	}
+}
+
+func TestCtrlWriteSetsNametableInT(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	p.WriteToPPUCtrl(0b11)
+	if !(p.t == 0x0C00) {
+		t.Error("Nametable select not copied into t")
+	}
+	p.WriteToPPUCtrl(0b01)
+	if !(p.t == 0x0400) {
+		t.Error("Nametable select not replaced in t")
+	}
+}
+
 func TestReadsStatusRegister(t *testing.T) {
 	p := setupTestPPU(VERTICAL)
-	p.status.value = 0b1100_1000
-	if !(p.ReadStatusRegister() == 0b1100_1000 &&
+	p.status.value = 0b1100_0000
+	// The low bits are not driven and read back the last register write
+	p.WriteToRegister(0b0011_1000)
+	if !(p.ReadStatusRegister() == 0b1101_1000 &&
 		!p.status.isVblankSet() &&
-		p.addr.is_hi &&
-		p.scroll.is_x) {
+		!p.w) {
 		t.Error("Wrong status register value")
 	}
 }
@@ -165,3 +189,944 @@ func TestWritesToMask(t *testing.T) {
 		t.Error("Wrong value for mask data write")
 	}
 }
+
+func TestSoftResetKeepsVramAndOAM(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	p.vram[0x0115] = 0x25
+	p.oam_data[0] = 0x15
+	p.WriteToPPUCtrl(0x80)
+	p.WriteToMask(0x18)
+	p.WriteToPPUAddr(0x21)
+	p.SoftReset()
+	if !(p.vram[0x0115] == 0x25 && p.oam_data[0] == 0x15) {
+		t.Error("Soft reset should keep VRAM and OAM")
+	}
+	if !(p.ctrl.value == 0 && p.mask.value == 0 && !p.w) {
+		t.Error("Soft reset should clear ctrl, mask and the write latch")
+	}
+}
+
+func TestPowerOnClearsVramAndOAM(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	p.vram[0x0115] = 0x25
+	p.oam_data[0] = 0x15
+	p.status.setVblank()
+	p.PowerOn()
+	if !(p.vram[0x0115] == 0 && p.oam_data[0] == 0 && !p.status.isVblankSet()) {
+		t.Error("Power on should clear VRAM, OAM and status")
+	}
+}
+
+// Dot renderer
+func runFrame(p *PPU) {
+	for !p.Tick(1) {
+	}
+}
+
+func runToScanline(p *PPU, scanline uint32) {
+	for p.scanline != scanline {
+		p.Tick(1)
+	}
+}
+
+func pixelAt(f *Frame, x, y int) RGB {
+	base := y*4*WITDH + x*4
+	return RGB{f.Data[base], f.Data[base+1], f.Data[base+2]}
+}
+
+// setupRenderPPU fills the first nametable with a solid tile using colour 1
+// of background palette 0, tile 2 only has its leftmost pixel set
+func setupRenderPPU() *PPU {
+	p := setupTestPPU(HORIZONTAL)
+	for y := 0; y < 8; y++ {
+		p.chr_rom[16+y] = 0xFF
+		p.chr_rom[32+y] = 0x80
+	}
+	for i := 0; i < 0x3C0; i++ {
+		p.vram[i] = 1
+	}
+	p.palette_table[0] = 0x0F
+	p.palette_table[1] = 0x30
+	p.palette_table[0x11] = 0x27
+	return p
+}
+
+func TestDotRendererDrawsBackground(t *testing.T) {
+	p := setupRenderPPU()
+	p.vram[1] = 0
+	p.WriteToMask(0b0000_1010)
+	runFrame(p)
+	runFrame(p)
+	if !(pixelAt(p.Frame(), 0, 0) == SYSTEM_PALLETE[0x30] && pixelAt(p.Frame(), 239, 200) == SYSTEM_PALLETE[0x30]) {
+		t.Error("Background tile not drawn")
+	}
+	if !(pixelAt(p.Frame(), 8, 0) == SYSTEM_PALLETE[0x0F]) {
+		t.Error("Transparent background should show the backdrop")
+	}
+}
+
+func TestDotRendererShowsMidFramePaletteChange(t *testing.T) {
+	p := setupRenderPPU()
+	p.WriteToMask(0b0000_1010)
+	runFrame(p)
+	runToScanline(p, 120)
+	p.palette_table[1] = 0x16
+	runFrame(p)
+	if !(pixelAt(p.Frame(), 0, 0) == SYSTEM_PALLETE[0x30] && pixelAt(p.Frame(), 0, 200) == SYSTEM_PALLETE[0x16]) {
+		t.Error("Mid frame palette change not visible")
+	}
+}
+
+func TestDotRendererDrawsSprites(t *testing.T) {
+	p := setupRenderPPU()
+	p.WriteToMask(0b0001_1110)
+	// Sprite at x=20 covering lines 10 to 17
+	p.oam_data[0] = 9
+	p.oam_data[1] = 1
+	p.oam_data[3] = 20
+	// Flipped sprite with only its rightmost pixel set at x=40
+	p.oam_data[4] = 9
+	p.oam_data[5] = 2
+	p.oam_data[6] = 0b0100_0000
+	p.oam_data[7] = 40
+	for i := 8; i < len(p.oam_data); i++ {
+		p.oam_data[i] = 0xFF
+	}
+	runFrame(p)
+	runFrame(p)
+	f := p.Frame()
+	if !(pixelAt(f, 20, 10) == SYSTEM_PALLETE[0x27] && pixelAt(f, 27, 17) == SYSTEM_PALLETE[0x27]) {
+		t.Error("Sprite not drawn")
+	}
+	if !(pixelAt(f, 19, 10) == SYSTEM_PALLETE[0x30] && pixelAt(f, 20, 9) == SYSTEM_PALLETE[0x30] && pixelAt(f, 20, 18) == SYSTEM_PALLETE[0x30]) {
+		t.Error("Sprite drawn outside its area")
+	}
+	if !(pixelAt(f, 47, 10) == SYSTEM_PALLETE[0x27] && pixelAt(f, 40, 10) == SYSTEM_PALLETE[0x30]) {
+		t.Error("Horizontally flipped sprite not drawn right")
+	}
+}
+
+func TestFrameRenderModeUsesWholeFrameRenderer(t *testing.T) {
+	p := setupRenderPPU()
+	p.SetRenderMode(RENDER_FRAME)
+	p.WriteToMask(0b0000_1010)
+	runFrame(p)
+	if !(pixelAt(p.Frame(), 0, 0) == SYSTEM_PALLETE[0x30]) {
+		t.Error("Frame renderer not run at the end of the frame")
+	}
+}
+
+// setupScrollPPU puts the solid tile in the first nametable and leaves the
+// second one transparent, the two sit side by side with vertical mirroring
+func setupScrollPPU() *PPU {
+	p := setupRenderPPU()
+	p.mirroring = VERTICAL
+	for i := 0x400; i < 0x7C0; i++ {
+		p.vram[i] = 0
+	}
+	return p
+}
+
+func TestDotRendererScrollsAcrossNametables(t *testing.T) {
+	p := setupScrollPPU()
+	p.WriteToMask(0b0000_1010)
+	p.WriteToScroll(125)
+	p.WriteToScroll(0)
+	runFrame(p)
+	runFrame(p)
+	f := p.Frame()
+	if !(pixelAt(f, 130, 50) == SYSTEM_PALLETE[0x30] && pixelAt(f, 131, 50) == SYSTEM_PALLETE[0x0F]) {
+		t.Error("First nametable should end at x=131 when scrolled by 125")
+	}
+	if !(pixelAt(f, 0, 50) == SYSTEM_PALLETE[0x30] && pixelAt(f, 255, 50) == SYSTEM_PALLETE[0x0F]) {
+		t.Error("Scrolled background not drawn")
+	}
+}
+
+func TestDotRendererStartsAtSelectedNametable(t *testing.T) {
+	p := setupScrollPPU()
+	p.WriteToMask(0b0000_1010)
+	p.WriteToPPUCtrl(0b01)
+	runFrame(p)
+	runFrame(p)
+	if !(pixelAt(p.Frame(), 0, 0) == SYSTEM_PALLETE[0x0F]) {
+		t.Error("Background should come from the second nametable")
+	}
+}
+
+func TestDotRendererScrollsVertically(t *testing.T) {
+	p := setupScrollPPU()
+	p.mirroring = HORIZONTAL
+	// Make the bottom 8 rows of the first nametable transparent
+	for i := 22 * 32; i < 0x3C0; i++ {
+		p.vram[i] = 0
+	}
+	p.WriteToMask(0b0000_1010)
+	p.WriteToScroll(0)
+	p.WriteToScroll(20)
+	runFrame(p)
+	runFrame(p)
+	f := p.Frame()
+	if !(pixelAt(f, 10, 155) == SYSTEM_PALLETE[0x30] && pixelAt(f, 10, 156) == SYSTEM_PALLETE[0x0F]) {
+		t.Error("Vertical scroll not applied")
+	}
+}
+
+// setupSprite0PPU places the solid sprite 0 at (x, 49) over the solid
+// background and hides all other sprites
+func setupSprite0PPU(x uint8) *PPU {
+	p := setupRenderPPU()
+	for i := range p.oam_data {
+		p.oam_data[i] = 0xFF
+	}
+	p.oam_data[0] = 49
+	p.oam_data[1] = 1
+	p.oam_data[2] = 0
+	p.oam_data[3] = x
+	p.WriteToMask(0b0001_1110)
+	return p
+}
+
+func TestSprite0HitSetWhenOpaquePixelsOverlap(t *testing.T) {
+	p := setupSprite0PPU(100)
+	runFrame(p)
+	runToScanline(p, 50)
+	for p.cycles <= 100 {
+		p.Tick(1)
+	}
+	if p.status.isSprite0HitSet() {
+		t.Error("Sprite 0 hit set before the first overlapping pixel")
+	}
+	p.Tick(1)
+	if !p.status.isSprite0HitSet() {
+		t.Error("Sprite 0 hit not set at the first overlapping pixel")
+	}
+	runToScanline(p, PRE_RENDER_SCANLINE)
+	p.Tick(2)
+	if p.status.isSprite0HitSet() {
+		t.Error("Sprite 0 hit should be cleared on the pre-render line")
+	}
+}
+
+func TestSprite0HitNeedsOpaqueBackground(t *testing.T) {
+	p := setupSprite0PPU(100)
+	for i := 0; i < 0x3C0; i++ {
+		p.vram[i] = 0
+	}
+	runFrame(p)
+	runToScanline(p, 100)
+	if p.status.isSprite0HitSet() {
+		t.Error("Sprite 0 hit over a transparent background")
+	}
+}
+
+func TestSprite0HitNeedsRendering(t *testing.T) {
+	p := setupSprite0PPU(100)
+	p.WriteToMask(0b0000_1110)
+	runFrame(p)
+	runToScanline(p, 100)
+	if p.status.isSprite0HitSet() {
+		t.Error("Sprite 0 hit with sprite rendering disabled")
+	}
+}
+
+func TestSprite0HitNotAtX255(t *testing.T) {
+	p := setupSprite0PPU(255)
+	runFrame(p)
+	runToScanline(p, 100)
+	if p.status.isSprite0HitSet() {
+		t.Error("Sprite 0 hit at x=255")
+	}
+}
+
+func TestSprite0HitClippedInLeftColumn(t *testing.T) {
+	p := setupSprite0PPU(0)
+	p.WriteToMask(0b0001_1100)
+	runFrame(p)
+	runToScanline(p, 51)
+	if p.status.isSprite0HitSet() {
+		t.Error("Sprite 0 hit in the clipped left column")
+	}
+	p = setupSprite0PPU(0)
+	runFrame(p)
+	runToScanline(p, 51)
+	if !p.status.isSprite0HitSet() {
+		t.Error("Sprite 0 hit missing in the unclipped left column")
+	}
+}
+
+func TestSprite0HitInFrameRenderMode(t *testing.T) {
+	p := setupSprite0PPU(100)
+	p.SetRenderMode(RENDER_FRAME)
+	runFrame(p)
+	runToScanline(p, 51)
+	if !p.status.isSprite0HitSet() {
+		t.Error("Sprite 0 hit not set in frame render mode")
+	}
+}
+
+// setupSpriteRowPPU hides all sprites and then puts n sprites on lines 50
+// to 57, 10 pixels apart starting at x=0
+func setupSpriteRowPPU(n int) *PPU {
+	p := setupRenderPPU()
+	for i := range p.oam_data {
+		p.oam_data[i] = 0xFF
+	}
+	for i := 0; i < n; i++ {
+		p.oam_data[i*4] = 49
+		p.oam_data[i*4+1] = 1
+		p.oam_data[i*4+2] = 0
+		p.oam_data[i*4+3] = uint8(i * 10)
+	}
+	p.WriteToMask(0b0001_1110)
+	return p
+}
+
+func TestSpriteLimitDrawsEightPerLine(t *testing.T) {
+	p := setupSpriteRowPPU(9)
+	runFrame(p)
+	runToScanline(p, 60)
+	f := p.Frame()
+	if !(pixelAt(f, 70, 50) == SYSTEM_PALLETE[0x27] && pixelAt(f, 80, 50) == SYSTEM_PALLETE[0x30]) {
+		t.Error("Ninth sprite on a line should not be drawn")
+	}
+	if !p.status.isSpriteOverflowSet() {
+		t.Error("Sprite overflow not set")
+	}
+	runToScanline(p, PRE_RENDER_SCANLINE)
+	p.Tick(2)
+	if p.status.isSpriteOverflowSet() {
+		t.Error("Sprite overflow should be cleared on the pre-render line")
+	}
+}
+
+func TestNoSpriteLimitDrawsAllAndReportsOverflow(t *testing.T) {
+	p := setupSpriteRowPPU(9)
+	p.SetNoSpriteLimit(true)
+	runFrame(p)
+	runToScanline(p, 60)
+	if !(pixelAt(p.Frame(), 80, 50) == SYSTEM_PALLETE[0x27]) {
+		t.Error("Ninth sprite should be drawn without the limit")
+	}
+	if !p.status.isSpriteOverflowSet() {
+		t.Error("Sprite overflow not set without the limit")
+	}
+}
+
+func TestNoSpriteOverflowForEightSprites(t *testing.T) {
+	p := setupSpriteRowPPU(8)
+	runFrame(p)
+	runToScanline(p, 60)
+	if p.status.isSpriteOverflowSet() {
+		t.Error("Eight sprites should not overflow")
+	}
+}
+
+func TestSpriteOverflowBugReadsWrongBytes(t *testing.T) {
+	// After sprite 8 misses, sprite 9's tile byte is checked as its y
+	p := setupSpriteRowPPU(8)
+	p.oam_data[9*4+1] = 49
+	runFrame(p)
+	runToScanline(p, 60)
+	if !p.status.isSpriteOverflowSet() {
+		t.Error("Expected a false overflow from the tile byte")
+	}
+	// And sprite 9 really on the line is missed for the same reason
+	p = setupSpriteRowPPU(8)
+	p.oam_data[9*4] = 49
+	p.oam_data[9*4+1] = 0
+	runFrame(p)
+	runToScanline(p, 60)
+	if p.status.isSpriteOverflowSet() {
+		t.Error("Expected the overflow to be missed")
+	}
+}
+
+func TestFrameRenderModeLimitsSpritesPerLine(t *testing.T) {
+	p := setupSpriteRowPPU(9)
+	p.SetRenderMode(RENDER_FRAME)
+	runFrame(p)
+	f := p.Frame()
+	if !(pixelAt(f, 70, 49) == SYSTEM_PALLETE[0x27] && pixelAt(f, 80, 49) == SYSTEM_PALLETE[0x30]) {
+		t.Error("Frame renderer should limit sprites per line")
+	}
+}
+
+// setupTallSpritePPU switches to 8x16 sprites and puts sprite 0 at (100,
+// 50) using the tile pair 2 and 3 of the second pattern table. The top tile
+// is solid and the bottom one only has its leftmost pixel set
+func setupTallSpritePPU(attr uint8) *PPU {
+	p := setupSprite0PPU(100)
+	p.chr_rom = make([]uint8, 0x2000)
+	copy(p.chr_rom[16:32], setupRenderPPU().chr_rom[16:32])
+	for y := 0; y < 8; y++ {
+		p.chr_rom[0x1020+y] = 0xFF
+		p.chr_rom[0x1030+y] = 0x80
+	}
+	p.oam_data[1] = 3
+	p.oam_data[2] = attr
+	p.WriteToPPUCtrl(0b0010_0000)
+	return p
+}
+
+func TestDotRendererDrawsTallSprites(t *testing.T) {
+	p := setupTallSpritePPU(0)
+	runFrame(p)
+	runFrame(p)
+	f := p.Frame()
+	if !(pixelAt(f, 107, 57) == SYSTEM_PALLETE[0x27] && pixelAt(f, 100, 65) == SYSTEM_PALLETE[0x27]) {
+		t.Error("8x16 sprite not drawn from the tile pair")
+	}
+	if !(pixelAt(f, 107, 58) == SYSTEM_PALLETE[0x30] && pixelAt(f, 100, 66) == SYSTEM_PALLETE[0x30]) {
+		t.Error("8x16 sprite drawn outside its area")
+	}
+}
+
+func TestTallSpriteVerticalFlipSwapsHalves(t *testing.T) {
+	p := setupTallSpritePPU(0b1000_0000)
+	runFrame(p)
+	runFrame(p)
+	f := p.Frame()
+	if !(pixelAt(f, 107, 50) == SYSTEM_PALLETE[0x30] && pixelAt(f, 100, 50) == SYSTEM_PALLETE[0x27] && pixelAt(f, 107, 58) == SYSTEM_PALLETE[0x27]) {
+		t.Error("Flipped 8x16 sprite should draw the bottom tile on top")
+	}
+}
+
+func TestFrameRenderModeDrawsTallSprites(t *testing.T) {
+	p := setupTallSpritePPU(0b1000_0000)
+	p.SetRenderMode(RENDER_FRAME)
+	runFrame(p)
+	f := p.Frame()
+	if !(pixelAt(f, 107, 49) == SYSTEM_PALLETE[0x30] && pixelAt(f, 107, 57) == SYSTEM_PALLETE[0x27] && pixelAt(f, 100, 64) == SYSTEM_PALLETE[0x27]) {
+		t.Error("Frame renderer not drawing flipped 8x16 sprites")
+	}
+}
+
+func TestSprite0HitOnTallSpriteBottomHalf(t *testing.T) {
+	p := setupTallSpritePPU(0)
+	// Leave only the bottom tile opaque
+	for y := 0; y < 8; y++ {
+		p.chr_rom[0x1020+y] = 0
+	}
+	runFrame(p)
+	runToScanline(p, 58)
+	if p.status.isSprite0HitSet() {
+		t.Error("Sprite 0 hit from the transparent top half")
+	}
+	runToScanline(p, 59)
+	if !p.status.isSprite0HitSet() {
+		t.Error("Sprite 0 hit missing for the bottom half")
+	}
+}
+
+// setupPriorityPPU puts a sprite behind the background at x=0 and x=100 on
+// lines 50 to 57, the background under x=100 is transparent. A front sprite
+// with another palette sits at x=2, mostly covered by the first sprite
+func setupPriorityPPU() *PPU {
+	p := setupSpriteRowPPU(0)
+	p.oam_data[0] = 49
+	p.oam_data[1] = 1
+	p.oam_data[2] = 0b0010_0000
+	p.oam_data[3] = 0
+	p.oam_data[4] = 49
+	p.oam_data[5] = 1
+	p.oam_data[6] = 0b0010_0000
+	p.oam_data[7] = 100
+	p.oam_data[8] = 49
+	p.oam_data[9] = 1
+	p.oam_data[10] = 1
+	p.oam_data[11] = 2
+	p.vram[6*32+12] = 0
+	p.vram[7*32+12] = 0
+	p.palette_table[0x15] = 0x16
+	return p
+}
+
+func checkPriority(t *testing.T, f *Frame, top int) {
+	if !(pixelAt(f, 3, top) == SYSTEM_PALLETE[0x30]) {
+		t.Error("Sprite behind an opaque background should be hidden")
+	}
+	if !(pixelAt(f, 100, top) == SYSTEM_PALLETE[0x27]) {
+		t.Error("Sprite behind a transparent background should show")
+	}
+	if !(pixelAt(f, 6, top) == SYSTEM_PALLETE[0x30]) {
+		t.Error("Front sprite should stay hidden behind the lower index sprite")
+	}
+}
+
+func TestDotRendererSpritePriority(t *testing.T) {
+	p := setupPriorityPPU()
+	runFrame(p)
+	runFrame(p)
+	checkPriority(t, p.Frame(), 50)
+	if !(pixelAt(p.Frame(), 9, 50) == SYSTEM_PALLETE[0x16]) {
+		t.Error("Front sprite should show where the hidden sprite ends")
+	}
+}
+
+func TestFrameRenderModeSpritePriority(t *testing.T) {
+	p := setupPriorityPPU()
+	p.SetRenderMode(RENDER_FRAME)
+	runFrame(p)
+	checkPriority(t, p.Frame(), 49)
+	if !(pixelAt(p.Frame(), 9, 49) == SYSTEM_PALLETE[0x16]) {
+		t.Error("Front sprite should show where the hidden sprite ends")
+	}
+}
+
+func TestGreyscaleMasksColour(t *testing.T) {
+	p := setupRenderPPU()
+	p.palette_table[1] = 0x16
+	p.WriteToMask(0b0000_1011)
+	runFrame(p)
+	runFrame(p)
+	if !(pixelAt(p.Frame(), 20, 20) == SYSTEM_PALLETE[0x10]) {
+		t.Error("Greyscale should keep only the brightness bits")
+	}
+}
+
+func TestEmphasisDimsOtherColours(t *testing.T) {
+	p := setupRenderPPU()
+	p.WriteToMask(0b0010_1010)
+	runFrame(p)
+	runFrame(p)
+	white := SYSTEM_PALLETE[0x30]
+	if !(pixelAt(p.Frame(), 20, 20) == RGB{white.R, dim(white.G), dim(white.B)}) {
+		t.Error("Red emphasis should dim green and blue")
+	}
+}
+
+func TestLeftColumnClipping(t *testing.T) {
+	p := setupSpriteRowPPU(1)
+	p.oam_data[3] = 4
+	// Background clipped, sprites shown in the left column
+	p.WriteToMask(0b0001_1100)
+	runFrame(p)
+	runFrame(p)
+	f := p.Frame()
+	if !(pixelAt(f, 0, 20) == SYSTEM_PALLETE[0x0F] && pixelAt(f, 8, 20) == SYSTEM_PALLETE[0x30]) {
+		t.Error("Background not clipped in the left column")
+	}
+	if !(pixelAt(f, 4, 50) == SYSTEM_PALLETE[0x27]) {
+		t.Error("Sprite should show in the left column")
+	}
+	p.WriteToMask(0b0001_1010)
+	runFrame(p)
+	f = p.Frame()
+	if !(pixelAt(f, 7, 50) == SYSTEM_PALLETE[0x30] && pixelAt(f, 8, 50) == SYSTEM_PALLETE[0x27]) {
+		t.Error("Sprite not clipped in the left column")
+	}
+}
+
+func TestRenderingDisabledShowsBackdrop(t *testing.T) {
+	p := setupRenderPPU()
+	runFrame(p)
+	if !(pixelAt(p.Frame(), 20, 20) == SYSTEM_PALLETE[0x0F]) {
+		t.Error("Rendering disabled should show the backdrop colour")
+	}
+	p.palette_table[3] = 0x21
+	p.WriteToPPUAddr(0x3F)
+	p.WriteToPPUAddr(0x03)
+	runFrame(p)
+	if !(pixelAt(p.Frame(), 20, 20) == SYSTEM_PALLETE[0x21]) {
+		t.Error("Rendering disabled should show the palette entry v points at")
+	}
+}
+
+func TestFrameRenderModeAppliesMask(t *testing.T) {
+	p := setupRenderPPU()
+	p.SetRenderMode(RENDER_FRAME)
+	p.WriteToMask(0b0000_1000)
+	runFrame(p)
+	f := p.Frame()
+	if !(pixelAt(f, 0, 20) == SYSTEM_PALLETE[0x0F] && pixelAt(f, 8, 20) == SYSTEM_PALLETE[0x30]) {
+		t.Error("Frame renderer should clip the left column")
+	}
+	p.WriteToMask(0)
+	runFrame(p)
+	if !(pixelAt(p.Frame(), 20, 20) == SYSTEM_PALLETE[0x0F]) {
+		t.Error("Frame renderer should show the backdrop with rendering disabled")
+	}
+}
+
+func TestPaletteMirrorsOnWriteAndRead(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	p.WriteToPPUAddr(0x3F)
+	p.WriteToPPUAddr(0x10)
+	p.WriteToData(0xE5)
+	if !(p.palette_table[0] == 0x25) {
+		t.Error("$3F10 should write the backdrop entry, masked to 6 bits")
+	}
+	p.WriteToPPUAddr(0x3F)
+	p.WriteToPPUAddr(0x04)
+	p.WriteToData(0x15)
+	// $3F14 mirrors $3F04 and $3FE4 mirrors $3F04 as well
+	p.WriteToPPUAddr(0x3F)
+	p.WriteToPPUAddr(0x14)
+	if !(p.ReadData() == 0x15) {
+		t.Error("$3F14 read should mirror $3F04")
+	}
+	p.WriteToPPUAddr(0x3F)
+	p.WriteToPPUAddr(0xE4)
+	if !(p.ReadData() == 0x15) {
+		t.Error("$3FE4 read should mirror $3F04")
+	}
+}
+
+func TestPaletteReadFillsBufferFromNametable(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	p.palette_table[1] = 0x21
+	p.vram[0x0701] = 0x99
+	p.WriteToRegister(0b1100_0000)
+	p.WriteToPPUAddr(0x3F)
+	p.WriteToPPUAddr(0x01)
+	if !(p.ReadData() == 0b1110_0001) {
+		t.Error("Palette read should be immediate with open bus top bits")
+	}
+	p.WriteToPPUAddr(0x00)
+	p.WriteToPPUAddr(0x00)
+	if !(p.ReadData() == 0x99) {
+		t.Error("Palette read should leave the nametable byte underneath in the buffer")
+	}
+}
+
+func TestHighNametableRangeMirrorsLowRange(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	p.WriteToPPUAddr(0x31)
+	p.WriteToPPUAddr(0x15)
+	p.WriteToData(0x25)
+	if !(p.vram[0x0115] == 0x25) {
+		t.Error("$3115 should write $2115")
+	}
+	p.WriteToPPUAddr(0x31)
+	p.WriteToPPUAddr(0x15)
+	p.ReadData()
+	if !(p.ReadData() == 0x25) {
+		t.Error("$3115 should read $2115")
+	}
+}
+
+func TestChrRomIgnoresWrites(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	p.WriteToPPUAddr(0x00)
+	p.WriteToPPUAddr(0x15)
+	p.WriteToData(0x25)
+	if !(p.chr_rom[0x15] == 0 && p.v == 0x16) {
+		t.Error("CHR ROM write should be ignored but still increment v")
+	}
+}
+
+func TestFourScreenKeepsNametablesApart(t *testing.T) {
+	p := setupTestPPU(FOUR_SCREEN)
+	for i, hi := range []uint8{0x20, 0x24, 0x28, 0x2C} {
+		p.WriteToPPUAddr(hi)
+		p.WriteToPPUAddr(0x15)
+		p.WriteToData(uint8(i + 1))
+	}
+	if !(p.vram[0x0015] == 1 && p.vram[0x0415] == 2 && p.vram[0x0815] == 3 && p.vram[0x0C15] == 4) {
+		t.Error("Four screen nametables should not alias")
+	}
+	p.WriteToPPUAddr(0x3C)
+	p.WriteToPPUAddr(0x15)
+	p.ReadData()
+	if !(p.ReadData() == 4) {
+		t.Error("$3C15 should mirror the fourth nametable")
+	}
+}
+
+// romNametables is a cartridge that answers every nametable read with the
+// low byte of the address and records writes
+type romNametables struct {
+	written map[uint16]uint8
+}
+
+func (r *romNametables) ReadNametable(addr uint16) uint8 {
+	return uint8(addr)
+}
+
+func (r *romNametables) WriteNametable(addr uint16, v uint8) {
+	r.written[addr] = v
+}
+
+func TestCartridgeCanServeNametables(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	n := &romNametables{written: map[uint16]uint8{}}
+	p.SetNametables(n)
+	p.WriteToPPUAddr(0x35)
+	p.WriteToPPUAddr(0x15)
+	p.WriteToData(0x25)
+	if !(n.written[0x2515] == 0x25 && p.vram[0x0515] == 0 && p.vram[0x0115] == 0) {
+		t.Error("Nametable write should go to the cartridge")
+	}
+	p.WriteToPPUAddr(0x24)
+	p.WriteToPPUAddr(0x37)
+	p.ReadData()
+	if !(p.ReadData() == 0x37) {
+		t.Error("Nametable read should come from the cartridge")
+	}
+}
+
+func TestDotRendererFetchesCartridgeNametables(t *testing.T) {
+	p := setupRenderPPU()
+	p.SetNametables(&romNametables{written: map[uint16]uint8{}})
+	p.WriteToMask(0b0000_1010)
+	runFrame(p)
+	runFrame(p)
+	// Column 1 reads tile 1 and column 2 reads tile 2 from the cartridge
+	f := p.Frame()
+	if !(pixelAt(f, 0, 0) == SYSTEM_PALLETE[0x0F] && pixelAt(f, 8, 0) == SYSTEM_PALLETE[0x30] && pixelAt(f, 17, 0) == SYSTEM_PALLETE[0x0F]) {
+		t.Error("Background not fetched from cartridge nametables")
+	}
+}
+
+func dotsInFrame(p *PPU) int {
+	dots := 1
+	for !p.Tick(1) {
+		dots++
+	}
+	return dots
+}
+
+func TestOddFramesSkipADotWhenRendering(t *testing.T) {
+	p := setupRenderPPU()
+	p.WriteToMask(0b0000_1000)
+	even, odd := dotsInFrame(p), dotsInFrame(p)
+	if !(even == 341*262 && odd == 341*262-1) {
+		t.Errorf("Expected frames of %d and %d dots, got %d and %d", 341*262, 341*262-1, even, odd)
+	}
+	p.WriteToMask(0)
+	even, odd = dotsInFrame(p), dotsInFrame(p)
+	if !(even == 341*262 && odd == 341*262) {
+		t.Error("No dot should be skipped with rendering disabled")
+	}
+}
+
+func TestPowerOnIgnoresWritesDuringWarmup(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	p.PowerOn()
+	p.WriteToPPUCtrl(0x80)
+	p.WriteToMask(0x18)
+	p.WriteToScroll(0x25)
+	p.WriteToPPUAddr(0x21)
+	p.WriteOAMData(0x15)
+	if !(p.ctrl.value == 0 && p.mask.value == 0 && p.t == 0 && !p.w) {
+		t.Error("Writes during the warm-up should be ignored")
+	}
+	if !(p.oam_data[0] == 0x15) {
+		t.Error("OAM writes are not affected by the warm-up")
+	}
+	for i := 0; i < NTSC_WARMUP_CYCLES*3; i++ {
+		p.Tick(1)
+	}
+	p.WriteToPPUCtrl(0x80)
+	if !(p.ctrl.value == 0x80) {
+		t.Error("Writes after the warm-up should be accepted")
+	}
+}
+
+func TestWritesIgnoredDuringWarmupAfterSoftReset(t *testing.T) {
+	b := setupTestBus([]uint8{})
+	b.SoftReset()
+	b.MemWrite(0x2000, 0x80)
+	if !(b.ppu.ctrl.value == 0) {
+		t.Error("A $2000 write right after reset should be ignored")
+	}
+	for i := 0; i < NTSC_WARMUP_CYCLES; i++ {
+		b.Tick(1)
+	}
+	b.MemWrite(0x2000, 0x80)
+	if !(b.ppu.ctrl.value == 0x80) {
+		t.Error("Writes after the warm-up should be accepted")
+	}
+}
+
+func TestWarmupEndsBeforePreRenderLine(t *testing.T) {
+	for _, r := range []Region{REGION_NTSC, REGION_PAL, REGION_DENDY} {
+		p := setupTestPPU(VERTICAL)
+		p.SetRegion(r)
+		p.PowerOn()
+		dots := p.warmupDots()
+		line := dots / DOTS_PER_SCANLINE
+		if !(line == p.preRenderLine()-1 || (line == p.preRenderLine() && dots%DOTS_PER_SCANLINE < 60)) {
+			t.Errorf("%s warm-up should end about the start of the pre-render line, ends on line %d", r, line)
+		}
+	}
+}
+
+func runToDot(p *PPU, scanline uint32, dot uint32) {
+	for !(p.scanline == scanline && p.cycles == dot) {
+		p.Tick(1)
+	}
+}
+
+func TestNMIRaisedOncePerVblank(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	p.WriteToPPUCtrl(0x80)
+	runToDot(p, 241, 2)
+	if !(p.status.isVblankSet() && p.PollNMIStatus() == nil) {
+		t.Error("Vblank should be set at dot 1 with the NMI not yet seen by the CPU")
+	}
+	p.Tick(3)
+	if p.PollNMIStatus() == nil {
+		t.Error("NMI not raised at the start of vblank")
+	}
+	p.Tick(3)
+	if p.PollNMIStatus() != nil {
+		t.Error("NMI should be raised only once")
+	}
+}
+
+func TestStatusReadJustBeforeVblankSuppressesIt(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	p.WriteToPPUCtrl(0x80)
+	runToDot(p, 241, 1)
+	if p.ReadStatusRegister()&0x80 != 0 {
+		t.Error("Read before vblank should see it clear")
+	}
+	runToDot(p, 250, 0)
+	if p.status.isVblankSet() || p.PollNMIStatus() != nil {
+		t.Error("Vblank and NMI should be suppressed for the frame")
+	}
+	runFrame(p)
+	runToDot(p, 241, 5)
+	if !(p.status.isVblankSet() && p.PollNMIStatus() != nil) {
+		t.Error("Suppression should only last one frame")
+	}
+}
+
+func TestStatusReadAtVblankStartSuppressesNMI(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	p.WriteToPPUCtrl(0x80)
+	runToDot(p, 241, 2)
+	if p.ReadStatusRegister()&0x80 == 0 {
+		t.Error("Read at the start of vblank should see it set")
+	}
+	p.Tick(10)
+	if p.PollNMIStatus() != nil {
+		t.Error("NMI should be suppressed by the read")
+	}
+	p = setupTestPPU(VERTICAL)
+	p.WriteToPPUCtrl(0x80)
+	runToDot(p, 241, 4)
+	p.ReadStatusRegister()
+	if p.PollNMIStatus() == nil {
+		t.Error("A later read should not suppress the NMI")
+	}
+}
+
+func TestEnablingNMIInVblankRaisesItAfterNextInstruction(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	runToDot(p, 245, 0)
+	p.WriteToPPUCtrl(0x80)
+	p.Tick(12)
+	if p.PollNMIStatus() != nil {
+		t.Error("NMI enabled by a write should wait for one more instruction")
+	}
+	p.Tick(6)
+	if p.PollNMIStatus() == nil {
+		t.Error("NMI not raised after enabling it in vblank")
+	}
+	// Every rising edge raises another one
+	p.WriteToPPUCtrl(0x00)
+	p.WriteToPPUCtrl(0x80)
+	p.Tick(6)
+	p.PollNMIStatus()
+	p.Tick(6)
+	if p.PollNMIStatus() == nil {
+		t.Error("Re-enabling NMI in vblank should raise it again")
+	}
+}
+
+func TestDisablingNMIAtVblankStartSuppressesIt(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	p.WriteToPPUCtrl(0x80)
+	runToDot(p, 241, 2)
+	p.WriteToPPUCtrl(0x00)
+	p.Tick(10)
+	if p.PollNMIStatus() != nil {
+		t.Error("NMI disabled right as vblank starts should not be raised")
+	}
+}
+
+func TestPALFrameHas312ScanlinesAndNoSkip(t *testing.T) {
+	p := setupRenderPPU()
+	p.SetRegion(REGION_PAL)
+	p.WriteToMask(0b0000_1000)
+	even, odd := dotsInFrame(p), dotsInFrame(p)
+	if !(even == 341*312 && odd == 341*312) {
+		t.Errorf("Expected two frames of %d dots, got %d and %d", 341*312, even, odd)
+	}
+}
+
+func TestDendyVblankStartsOnLine291(t *testing.T) {
+	p := setupTestPPU(VERTICAL)
+	p.SetRegion(REGION_DENDY)
+	runToDot(p, 291, 0)
+	if !(!p.status.isVblankSet()) {
+		t.Error("Vblank should not be set before line 291")
+	}
+	runToDot(p, 291, 2)
+	if !(p.status.isVblankSet()) {
+		t.Error("Vblank should be set on line 291")
+	}
+}
+
+func TestPALSwapsRedAndGreenEmphasis(t *testing.T) {
+	p := setupRenderPPU()
+	p.SetRegion(REGION_PAL)
+	p.WriteToMask(0b0010_1010)
+	runFrame(p)
+	runFrame(p)
+	white := PAL_PALLETE[0x30]
+	if !(pixelAt(p.Frame(), 20, 20) == RGB{dim(white.R), white.G, dim(white.B)}) {
+		t.Error("Red emphasis on PAL should dim red and blue")
+	}
+}
+
+func TestPALPaletteKeepsHues(t *testing.T) {
+	red, blue := PAL_PALLETE[0x16], PAL_PALLETE[0x12]
+	if !(red.R > red.G && red.R > red.B && blue.B > blue.R && blue.B > blue.G) {
+		t.Error("PAL palette colours decoded with the wrong hue")
+	}
+}
+
+// runStatusRead runs BIT $2002 from the given PPU position, its read lands
+// 9 dots later
+func runStatusRead(scanline uint32, dot uint32) (*Bus, *CPU) {
+	b := setupTestBus([]uint8{0x2C, 0x02, 0x20})
+	c := InitCPU(b)
+	c.Reset()
+	b.ppu.WriteToPPUCtrl(0x80)
+	b.ppu.scanline = scanline
+	b.ppu.cycles = dot
+	c.Step(func() {})
+	return b, c
+}
+
+func TestStatusReadByCPUOnVblankDotSuppressesIt(t *testing.T) {
+	b, c := runStatusRead(240, 333)
+	if !(c.status&0b1000_0000 == 0) {
+		t.Error("BIT reading on the vblank dot should see it clear")
+	}
+	b.Tick(20)
+	if b.ppu.status.isVblankSet() || b.ppu.PollNMIStatus() != nil {
+		t.Error("Vblank and NMI should be suppressed by the read")
+	}
+	// One dot earlier the read misses the edge
+	b, c = runStatusRead(240, 332)
+	b.Tick(20)
+	if !(c.status&0b1000_0000 == 0 && b.ppu.status.isVblankSet() && b.ppu.PollNMIStatus() != nil) {
+		t.Error("A read before the vblank dot should not suppress it")
+	}
+}
+
+func TestStatusReadByCPUJustAfterVblankSuppressesNMI(t *testing.T) {
+	b, c := runStatusRead(240, 334)
+	if !(c.status&0b1000_0000 != 0) {
+		t.Error("BIT reading a dot after vblank starts should see it set")
+	}
+	b.Tick(20)
+	if b.ppu.PollNMIStatus() != nil {
+		t.Error("NMI should be suppressed by the read")
+	}
+}
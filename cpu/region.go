@@ -0,0 +1,167 @@
+package cpu
+
+import "math"
+
+type Region uint8
+
+const (
+	REGION_NTSC Region = iota
+	REGION_PAL
+	// Dendy is the common Famiclone, PAL frame length with NTSC-like timing
+	// inside the frame
+	REGION_DENDY
+)
+
+// Timing is everything that differs between the console regions
+type Timing struct {
+	CPUClockHz float64
+	FrameRate  float64
+	Scanlines  uint32
+	// Scanline vblank starts on, Dendy has 50 idle lines before it
+	VblankLine uint32
+	// PPU dots per CPU cycle as a fraction, 3 for NTSC and 16/5 for PAL
+	DotsPerCycle    uint
+	DotsPerCycleDiv uint
+	// Only the NTSC PPU skips a dot on odd frames
+	OddFrameSkip bool
+	// The PAL PPU swaps the red and green emphasis bits
+	SwapEmphasis bool
+	Palette      []RGB
+	// APU rates in CPU cycles
+	NoisePeriods [16]uint16
+	DMCRates     [16]uint16
+	// CPU cycles at which the frame counter clocks steps 1 to 5
+	FrameSteps [5]uint
+	// CPU cycles after power on until the PPU accepts register writes
+	WarmupCycles uint
+}
+
+var NTSC_NOISE_PERIODS = [16]uint16{4, 8, 16, 32, 64, 96, 128, 160, 202, 254, 380, 508, 762, 1016, 2034, 4068}
+var PAL_NOISE_PERIODS = [16]uint16{4, 8, 14, 30, 60, 88, 118, 148, 188, 236, 354, 472, 708, 944, 1890, 3778}
+
+var NTSC_DMC_RATES = [16]uint16{428, 380, 340, 320, 286, 254, 226, 214, 190, 160, 142, 128, 106, 84, 72, 54}
+var PAL_DMC_RATES = [16]uint16{398, 354, 316, 298, 276, 236, 210, 198, 176, 148, 132, 118, 98, 78, 66, 50}
+
+var NTSC_FRAME_STEPS = [5]uint{7457, 14913, 22371, 29829, 37281}
+var PAL_FRAME_STEPS = [5]uint{8313, 16627, 24939, 33253, 41565}
+
+// The PPU warm-up lasts until about the first pre-render line
+const NTSC_WARMUP_CYCLES = 29658
+const PAL_WARMUP_CYCLES = 33132
+const DENDY_WARMUP_CYCLES = 35350
+
+var TIMINGS = map[Region]Timing{
+	REGION_NTSC: {
+		CPUClockHz:      1789773,
+		FrameRate:       60.0988,
+		Scanlines:       262,
+		VblankLine:      241,
+		DotsPerCycle:    3,
+		DotsPerCycleDiv: 1,
+		OddFrameSkip:    true,
+		Palette:         SYSTEM_PALLETE,
+		NoisePeriods:    NTSC_NOISE_PERIODS,
+		DMCRates:        NTSC_DMC_RATES,
+		FrameSteps:      NTSC_FRAME_STEPS,
+		WarmupCycles:    NTSC_WARMUP_CYCLES,
+	},
+	REGION_PAL: {
+		CPUClockHz:      1662607,
+		FrameRate:       50.0070,
+		Scanlines:       312,
+		VblankLine:      241,
+		DotsPerCycle:    16,
+		DotsPerCycleDiv: 5,
+		SwapEmphasis:    true,
+		Palette:         PAL_PALLETE,
+		NoisePeriods:    PAL_NOISE_PERIODS,
+		DMCRates:        PAL_DMC_RATES,
+		FrameSteps:      PAL_FRAME_STEPS,
+		WarmupCycles:    PAL_WARMUP_CYCLES,
+	},
+	// The Dendy APU keeps the NTSC tables, it just runs slower
+	REGION_DENDY: {
+		CPUClockHz:      1773448,
+		FrameRate:       50.0070,
+		Scanlines:       312,
+		VblankLine:      291,
+		DotsPerCycle:    3,
+		DotsPerCycleDiv: 1,
+		Palette:         SYSTEM_PALLETE,
+		NoisePeriods:    NTSC_NOISE_PERIODS,
+		DMCRates:        NTSC_DMC_RATES,
+		FrameSteps:      NTSC_FRAME_STEPS,
+		WarmupCycles:    DENDY_WARMUP_CYCLES,
+	},
+}
+
+func (r Region) Timing() Timing {
+	return TIMINGS[r]
+}
+
+func (r Region) String() string {
+	switch r {
+	case REGION_PAL:
+		return "PAL"
+	case REGION_DENDY:
+		return "Dendy"
+	}
+	return "NTSC"
+}
+
+// The 2C07 puts out the same signal levels as the NTSC PPU with the colour
+// phases about 15 degrees earlier. Decoded at 23 degrees the signal comes
+// out close to SYSTEM_PALLETE, so the PAL table is decoded 15 degrees off
+// that to keep the two consistent
+const NTSC_DECODE_HUE = 23
+const PAL_HUE_SHIFT = -15
+
+var PAL_PALLETE = decodePalette(NTSC_DECODE_HUE + PAL_HUE_SHIFT)
+
+// Chroma gain that matches the saturation of SYSTEM_PALLETE
+const DECODE_SATURATION = 2.0
+
+// Composite levels of the PPU for the four brightness rows, low and high
+// half of the colour wave, with black at 0.518 and white at 1.962
+var signalLow = [4]float64{0.350, 0.518, 0.962, 1.550}
+var signalHigh = [4]float64{1.094, 1.506, 1.962, 1.962}
+
+// decodePalette samples the 12 phases of each colour's square wave and
+// decodes them as YUV, hue rotates the result in degrees
+func decodePalette(hue float64) []RGB {
+	const black, white = 0.518, 1.962
+	ret := make([]RGB, 64)
+	for c := range ret {
+		level, phase := c>>4, c&0x0F
+		lo, hi := signalLow[level], signalHigh[level]
+		if phase == 0 {
+			lo = hi
+		} else if phase == 0x0D {
+			hi = lo
+		} else if phase > 0x0D {
+			lo, hi = black, black
+		}
+		var y, u, v float64
+		for p := 0; p < 12; p++ {
+			s := lo
+			if (phase+p)%12 < 6 {
+				s = hi
+			}
+			s = (s - black) / (white - black)
+			angle := hue*math.Pi/180 - math.Pi*(float64(p)+0.5)/6
+			y += s / 12
+			u += DECODE_SATURATION * s * math.Cos(angle) / 12
+			v += DECODE_SATURATION * s * math.Sin(angle) / 12
+		}
+		ret[c] = RGB{
+			R: toByte(y + 1.140*v),
+			G: toByte(y - 0.395*u - 0.581*v),
+			B: toByte(y + 2.032*u),
+		}
+	}
+	return ret
+}
+
+func toByte(f float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(1, f)) * 255))
+}
@@ -5,11 +5,15 @@ const HEIGHT = 240
 
 type Frame struct {
 	Data []uint8
+	// Background pixels that are not transparent, sprites behind the
+	// background only show where this is false
+	bg_opaque []bool
 }
 
 func NewFrame() *Frame {
 	return &Frame{
-		Data: make([]uint8, WITDH*HEIGHT*4),
+		Data:      make([]uint8, WITDH*HEIGHT*4),
+		bg_opaque: make([]bool, WITDH*HEIGHT),
 	}
 }
 
@@ -24,10 +28,19 @@ func (f *Frame) SetPixel(x uint32, y uint32, rgb RGB) {
 }
 
 func (f *Frame) Render(p *PPU) {
+	if !p.isRenderingEnabled() {
+		backdrop := p.colour(p.readPalette(p.backdropIndex()))
+		for y := uint32(0); y < HEIGHT; y++ {
+			for x := uint32(0); x < WITDH; x++ {
+				f.SetPixel(x, y, backdrop)
+			}
+		}
+		return
+	}
 	// Render background
 	bank := p.ctrl.BnkdPatternAddress()
 	for i := 0; i < 0x3C0; i++ {
-		tile_nr := uint16(p.vram[i])
+		tile_nr := uint16(p.readNametable(0x2000 + uint16(i)))
 		tile_column := i % 32
 		tile_row := i / 32
 		tile := p.chr_rom[(bank + tile_nr*16):(bank + tile_nr*16 + 16)]
@@ -39,26 +52,33 @@ func (f *Frame) Render(p *PPU) {
 				value := (1&lower)<<1 | (1 & upper)
 				upper = upper >> 1
 				lower = lower >> 1
+				if !p.mask.isBackgrounRenderingSet() || (tile_column*8+x < 8 && !p.mask.isShowBackgroundSet()) {
+					value = 0
+				}
 				var rgb RGB
 				switch value {
 				case 0:
-					rgb = SYSTEM_PALLETE[palette[0]]
+					rgb = p.colour(palette[0])
 				case 1:
-					rgb = SYSTEM_PALLETE[palette[1]]
+					rgb = p.colour(palette[1])
 				case 2:
-					rgb = SYSTEM_PALLETE[palette[2]]
+					rgb = p.colour(palette[2])
 				case 3:
-					rgb = SYSTEM_PALLETE[palette[3]]
+					rgb = p.colour(palette[3])
 				default:
 					panic("Not valid rgb rom")
 				}
 				f.SetPixel(uint32(tile_column*8+x), uint32(tile_row*8+y), rgb)
+				f.bg_opaque[(tile_row*8+y)*WITDH+tile_column*8+x] = value != 0
 			}
 		}
 	}
-	// Render sprites
-	for i := len(p.oam_data) - 4; i >= 0; i -= 4 {
-		tile_idx := uint16(p.oam_data[i+1])
+	// Render sprites, front to back so that the first opaque sprite pixel
+	// claims the dot even when it is behind the background
+	shown := p.spritesShownPerLine()
+	claimed := make([]bool, WITDH*HEIGHT)
+	for i := 0; i < len(p.oam_data) && p.mask.isSpriteRenderingSet(); i += 4 {
+		tile_idx := p.oam_data[i+1]
 		tile_x := int(p.oam_data[i+3])
 		tile_y := int(p.oam_data[i])
 		flip_vertical := false
@@ -69,15 +89,23 @@ func (f *Frame) Render(p *PPU) {
 		if p.oam_data[i+2]>>6&1 == 1 {
 			flip_horizontal = true
 		}
+		behind := p.oam_data[i+2]&0b0010_0000 > 0
 		paletteIdx := p.oam_data[i+2] & 0b11
 		sprPallete := spritePallete(p, paletteIdx)
-		bank := p.ctrl.SprtPatternAddress()
+		height := int(p.ctrl.SpriteHeight())
 
-		tile := p.chr_rom[(bank + tile_idx*16):(bank + (tile_idx)*16 + 16)]
-
-		for y := 0; y < 8; y++ {
-			upper := tile[y]
-			lower := tile[y+8]
+		for y := 0; y < height; y++ {
+			line := tile_y + y
+			if line >= HEIGHT || !shown[i/4][line] {
+				continue
+			}
+			row := y
+			if flip_vertical {
+				row = height - 1 - y
+			}
+			addr := p.spritePatternAddr(tile_idx, row)
+			upper := p.chr_rom[addr]
+			lower := p.chr_rom[addr+8]
 			for x := 7; x >= 0; x-- {
 				value := (1&lower)<<1 | (1 & upper)
 				upper = upper >> 1
@@ -88,34 +116,55 @@ func (f *Frame) Render(p *PPU) {
 				case 0:
 					skip = true
 				case 1:
-					rgb = SYSTEM_PALLETE[sprPallete[1]]
+					rgb = p.colour(sprPallete[1])
 				case 2:
-					rgb = SYSTEM_PALLETE[sprPallete[2]]
+					rgb = p.colour(sprPallete[2])
 				case 3:
-					rgb = SYSTEM_PALLETE[sprPallete[3]]
+					rgb = p.colour(sprPallete[3])
 				default:
 					panic("Not valid rgb rom")
 				}
 				if skip {
 					continue
 				}
-				if !flip_horizontal && !flip_vertical {
-					f.SetPixel(uint32(tile_x+x), uint32(tile_y+y), rgb)
-				} else if flip_horizontal && !flip_vertical {
-					f.SetPixel(uint32(tile_x+7-x), uint32(tile_y+y), rgb)
-				} else if !flip_horizontal && flip_vertical {
-					f.SetPixel(uint32(tile_x+x), uint32(tile_y+7-y), rgb)
-				} else if flip_horizontal && flip_vertical {
-					f.SetPixel(uint32(tile_x+7-x), uint32(tile_y+7-y), rgb)
+				px := tile_x + x
+				if flip_horizontal {
+					px = tile_x + 7 - x
+				}
+				if px >= WITDH || (px < 8 && !p.mask.isShowSpritesSet()) || claimed[line*WITDH+px] {
+					continue
 				}
+				claimed[line*WITDH+px] = true
+				if behind && f.bg_opaque[line*WITDH+px] {
+					continue
+				}
+				f.SetPixel(uint32(px), uint32(line), rgb)
+			}
+		}
+	}
+}
+
+// spritesShownPerLine marks the lines each sprite is drawn on, only the
+// first SPRITES_PER_LINE sprites of a line are unless the limit is removed
+func (p *PPU) spritesShownPerLine() [64][HEIGHT]bool {
+	var shown [64][HEIGHT]bool
+	var count [HEIGHT]int
+	height := int(p.ctrl.SpriteHeight())
+	for n := 0; n < 64; n++ {
+		top := int(p.oam_data[n*4])
+		for line := top; line < top+height && line < HEIGHT; line++ {
+			if count[line] < SPRITES_PER_LINE || p.no_sprite_limit {
+				shown[n][line] = true
 			}
+			count[line]++
 		}
 	}
+	return shown
 }
 
 func bgPallete(p *PPU, tile_col uint, tile_row uint) [4]uint8 {
 	tableIdx := tile_row/4*8 + tile_col/4
-	attrByte := p.vram[0x3C0+tableIdx]
+	attrByte := p.readNametable(0x23C0 + uint16(tableIdx))
 	col_idx := tile_col % 4 / 2
 	row_idx := tile_row % 4 / 2
 	var palletIdx uint8
@@ -136,3 +185,355 @@ func spritePallete(p *PPU, palette_idx uint8) [4]uint8 {
 	start := 0x11 + uint(palette_idx*4)
 	return [4]uint8{0, p.palette_table[start], p.palette_table[start+1], p.palette_table[start+2]}
 }
+
+type RenderMode uint8
+
+const (
+	// Pixels are produced dot by dot as the PPU ticks
+	RENDER_DOTS RenderMode = iota
+	// The whole frame is drawn at once when it ends, faster but mid-frame
+	// changes to the PPU state are not visible
+	RENDER_FRAME
+)
+
+const DOTS_PER_SCANLINE = 341
+
+// Pre-render line of NTSC, other regions have a longer frame
+const PRE_RENDER_SCANLINE = 261
+
+// A sprite picked for the scanline being drawn, the pattern bytes are
+// already flipped and x counts down until the sprite starts shifting out
+type lineSprite struct {
+	x    uint8
+	lo   uint8
+	hi   uint8
+	attr uint8
+	zero bool // sprite 0, the one that can set the hit flag
+}
+
+func (p *PPU) isRenderingEnabled() bool {
+	return p.mask.isBackgrounRenderingSet() || p.mask.isSpriteRenderingSet()
+}
+
+// renderDot runs the background and sprite pipelines for the current dot
+// of a visible or the pre-render scanline
+func (p *PPU) renderDot() {
+	dot := p.cycles
+	visible := p.scanline < HEIGHT
+	if p.isRenderingEnabled() {
+		if (dot >= 2 && dot <= 257) || (dot >= 321 && dot <= 337) {
+			p.shiftRegisters(dot)
+			switch (dot - 1) % 8 {
+			case 0:
+				p.loadBackgroundShifters()
+				p.bg_next_tile = p.readVram(p.nametableAddr())
+			case 2:
+				p.bg_next_attr = p.fetchAttribute()
+			case 4:
+				p.bg_next_lo = p.readVram(p.patternAddr())
+			case 6:
+				p.bg_next_hi = p.readVram(p.patternAddr() + 8)
+			case 7:
+				p.incrementX()
+			}
+		}
+		if dot == 256 {
+			p.incrementY()
+		}
+		if dot == 257 {
+			p.copyHorizontal()
+			p.evaluateSprites()
+		}
+		if p.scanline == p.preRenderLine() && dot >= 280 && dot <= 304 {
+			p.copyVertical()
+		}
+	}
+	if visible && dot >= 1 && dot <= WITDH {
+		p.outputPixel(dot-1, p.scanline)
+	}
+}
+
+func (p *PPU) nametableAddr() uint16 {
+	return 0x2000 | (p.v & 0x0FFF)
+}
+
+func (p *PPU) fetchAttribute() uint8 {
+	attr := p.readVram(0x23C0 | (p.v & 0x0C00) | ((p.v >> 4) & 0x38) | ((p.v >> 2) & 0x07))
+	shift := ((p.v >> 4) & 4) | (p.v & 2)
+	return (attr >> shift) & 0b11
+}
+
+func (p *PPU) patternAddr() uint16 {
+	return p.ctrl.BnkdPatternAddress() + uint16(p.bg_next_tile)*16 + (p.v>>12)&0b111
+}
+
+// incrementX moves v to the next tile, wrapping into the horizontally
+// adjacent nametable
+func (p *PPU) incrementX() {
+	if p.v&0x001F == 31 {
+		p.v &^= 0x001F
+		p.v ^= 0x0400
+	} else {
+		p.v++
+	}
+}
+
+// incrementY moves v to the next pixel row. Coarse y wraps into the
+// vertically adjacent nametable after row 29, rows 30 and 31 are the
+// attribute table and wrap without switching
+func (p *PPU) incrementY() {
+	if p.v&0x7000 != 0x7000 {
+		p.v += 0x1000
+		return
+	}
+	p.v &^= 0x7000
+	y := (p.v & 0x03E0) >> 5
+	if y == 29 {
+		y = 0
+		p.v ^= 0x0800
+	} else if y == 31 {
+		y = 0
+	} else {
+		y++
+	}
+	p.v = (p.v &^ 0x03E0) | y<<5
+}
+
+func (p *PPU) copyHorizontal() {
+	p.v = (p.v &^ 0x041F) | (p.t & 0x041F)
+}
+
+func (p *PPU) copyVertical() {
+	p.v = (p.v &^ 0x7BE0) | (p.t & 0x7BE0)
+}
+
+func (p *PPU) loadBackgroundShifters() {
+	p.bg_shift_lo = (p.bg_shift_lo & 0xFF00) | uint16(p.bg_next_lo)
+	p.bg_shift_hi = (p.bg_shift_hi & 0xFF00) | uint16(p.bg_next_hi)
+	// The attribute bits are the same for all 8 pixels of a tile
+	var lo, hi uint16
+	if p.bg_next_attr&0b01 > 0 {
+		lo = 0xFF
+	}
+	if p.bg_next_attr&0b10 > 0 {
+		hi = 0xFF
+	}
+	p.bg_attr_lo = (p.bg_attr_lo & 0xFF00) | lo
+	p.bg_attr_hi = (p.bg_attr_hi & 0xFF00) | hi
+}
+
+func (p *PPU) shiftRegisters(dot uint32) {
+	p.bg_shift_lo <<= 1
+	p.bg_shift_hi <<= 1
+	p.bg_attr_lo <<= 1
+	p.bg_attr_hi <<= 1
+	if dot > 257 {
+		return
+	}
+	for i := range p.line_sprites {
+		s := &p.line_sprites[i]
+		if s.x > 0 {
+			s.x--
+		} else {
+			s.lo <<= 1
+			s.hi <<= 1
+		}
+	}
+}
+
+// The hardware copies at most this many sprites into secondary OAM
+const SPRITES_PER_LINE = 8
+
+// evaluateSprites picks the sprites for the next scanline. OAM holds the
+// sprite top minus one, so a sprite at y covers the lines after y
+func (p *PPU) evaluateSprites() {
+	p.line_sprites = p.line_sprites[:0]
+	if p.scanline >= HEIGHT {
+		return
+	}
+	n := 0
+	for ; n < 64 && len(p.line_sprites) < SPRITES_PER_LINE; n++ {
+		if p.spriteOnLine(p.oam_data[n*4]) {
+			p.addLineSprite(n)
+		}
+	}
+	if len(p.line_sprites) == SPRITES_PER_LINE && p.findOverflow(n) {
+		p.status.setSpriteOverflow()
+	}
+	if !p.no_sprite_limit {
+		return
+	}
+	for ; n < 64; n++ {
+		if p.spriteOnLine(p.oam_data[n*4]) {
+			p.addLineSprite(n)
+		}
+	}
+}
+
+func (p *PPU) spriteOnLine(y uint8) bool {
+	row := int(p.scanline) - int(y)
+	return row >= 0 && row < int(p.ctrl.SpriteHeight())
+}
+
+// findOverflow continues the search after secondary OAM is full. The
+// hardware increments the byte offset along with the sprite index, so from
+// the second check on it compares tile, attribute or x bytes as if they were
+// y, which both misses and invents overflows
+func (p *PPU) findOverflow(n int) bool {
+	m := 0
+	for ; n < 64; n++ {
+		if p.spriteOnLine(p.oam_data[n*4+m]) {
+			return true
+		}
+		m = (m + 1) & 0b11
+	}
+	return false
+}
+
+func (p *PPU) addLineSprite(n int) {
+	i := n * 4
+	row := int(p.scanline) - int(p.oam_data[i])
+	attr := p.oam_data[i+2]
+	if attr&0b1000_0000 > 0 {
+		row = int(p.ctrl.SpriteHeight()) - 1 - row
+	}
+	addr := p.spritePatternAddr(p.oam_data[i+1], row)
+	lo := p.readVram(addr)
+	hi := p.readVram(addr + 8)
+	if attr&0b0100_0000 > 0 {
+		lo = reverseBits(lo)
+		hi = reverseBits(hi)
+	}
+	p.line_sprites = append(p.line_sprites, lineSprite{x: p.oam_data[i+3], lo: lo, hi: hi, attr: attr, zero: n == 0})
+}
+
+// spritePatternAddr is the address of the low pattern byte for a row of a
+// sprite, rows 8 to 15 of an 8x16 sprite come from the second tile of the
+// pair. 8x16 sprites ignore the ctrl pattern table and take it from bit 0
+// of the tile index instead
+func (p *PPU) spritePatternAddr(tile uint8, row int) uint16 {
+	if p.ctrl.SpriteHeight() == 8 {
+		return p.ctrl.SprtPatternAddress() + uint16(tile)*16 + uint16(row)
+	}
+	bank := uint16(tile&1) * 0x1000
+	top := uint16(tile &^ 1)
+	if row >= 8 {
+		top++
+		row -= 8
+	}
+	return bank + top*16 + uint16(row)
+}
+
+func reverseBits(b uint8) uint8 {
+	var r uint8
+	for i := 0; i < 8; i++ {
+		r = r<<1 | b&1
+		b >>= 1
+	}
+	return r
+}
+
+func (p *PPU) outputPixel(x uint32, y uint32) {
+	if !p.isRenderingEnabled() {
+		p.frame.SetPixel(x, y, p.colour(p.readPalette(p.backdropIndex())))
+		return
+	}
+	var bgPixel, bgPalette uint8
+	if p.mask.isBackgrounRenderingSet() && (x >= 8 || p.mask.isShowBackgroundSet()) {
+		// Fine x picks which of the top eight shifter bits is on screen
+		shift := 15 - p.fine_x
+		bgPixel = uint8((p.bg_shift_hi>>shift)&1)<<1 | uint8((p.bg_shift_lo>>shift)&1)
+		bgPalette = uint8((p.bg_attr_hi>>shift)&1)<<1 | uint8((p.bg_attr_lo>>shift)&1)
+	}
+	var sprPixel, sprPalette uint8
+	sprZero, sprBehind := false, false
+	if p.mask.isSpriteRenderingSet() && (x >= 8 || p.mask.isShowSpritesSet()) {
+		for _, s := range p.line_sprites {
+			if s.x > 0 {
+				continue
+			}
+			pixel := (s.hi>>7)<<1 | s.lo>>7
+			if pixel != 0 {
+				sprPixel = pixel
+				sprPalette = 4 + s.attr&0b11
+				sprZero = s.zero
+				sprBehind = s.attr&0b0010_0000 > 0
+				break
+			}
+		}
+	}
+	if sprZero && bgPixel != 0 && p.isSprite0HitPossible(x) {
+		p.status.setSprite0Flag()
+	}
+	// The sprite picked above hides the ones after it even when it loses
+	// to the background here
+	var idx uint8
+	if sprPixel != 0 && (bgPixel == 0 || !sprBehind) {
+		idx = sprPalette<<2 | sprPixel
+	} else if bgPixel != 0 {
+		idx = bgPalette<<2 | bgPixel
+	}
+	p.frame.SetPixel(x, y, p.colour(p.readPalette(idx)))
+}
+
+// With rendering disabled the backdrop is palette entry 0, unless v points
+// into the palette, then that entry is shown instead
+func (p *PPU) backdropIndex() uint8 {
+	if p.v&0x3F00 == 0x3F00 {
+		return uint8(p.v & 0x1F)
+	}
+	return 0
+}
+
+// colour looks up a palette entry in the region's system palette and
+// applies the greyscale and emphasis bits of the mask register
+func (p *PPU) colour(c uint8) RGB {
+	if p.mask.isGreyScaleSet() {
+		c &= 0x30
+	}
+	rgb := p.timing.Palette[c&0x3F]
+	red, green := p.mask.isEmphaziseRedSet(), p.mask.isEmphaziseGreenSet()
+	if p.timing.SwapEmphasis {
+		red, green = green, red
+	}
+	if red {
+		rgb.G, rgb.B = dim(rgb.G), dim(rgb.B)
+	}
+	if green {
+		rgb.R, rgb.B = dim(rgb.R), dim(rgb.B)
+	}
+	if p.mask.isEmphaziseBlueSet() {
+		rgb.R, rgb.G = dim(rgb.R), dim(rgb.G)
+	}
+	return rgb
+}
+
+// Emphasising a colour darkens the other two by about a quarter
+func dim(v uint8) uint8 {
+	return uint8(uint16(v) * 3 / 4)
+}
+
+// A hit needs both layers enabled, which outputPixel already covers by
+// leaving disabled layers transparent. It never happens at x=255, nor in
+// the left 8 pixels when either layer is clipped there
+func (p *PPU) isSprite0HitPossible(x uint32) bool {
+	if x == 255 {
+		return false
+	}
+	if x < 8 && (!p.mask.isShowBackgroundSet() || !p.mask.isShowSpritesSet()) {
+		return false
+	}
+	return true
+}
+
+// The whole frame renderer draws no pixels while the frame runs, so the hit
+// is assumed at the top left pixel of sprite 0 without checking opacity
+func (p *PPU) approximateSprite0Hit() {
+	if !p.mask.isBackgrounRenderingSet() || !p.mask.isSpriteRenderingSet() {
+		return
+	}
+	x := uint32(p.oam_data[3])
+	if p.scanline == uint32(p.oam_data[0])+1 && p.cycles == x+1 && p.isSprite0HitPossible(x) {
+		p.status.setSprite0Flag()
+	}
+}
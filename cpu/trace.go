@@ -24,16 +24,16 @@ func TraceCPU(c *CPU) string {
 		instr_part = fmt.Sprintf("%02X", op_code.code)
 		assem_part = fmt.Sprintf("%s A", op_code.name)
 	case IMMEDIATE:
-		p1 := c.MemRead(c.ProgramCounter() + 1)
+		p1 := traceRead(c, c.ProgramCounter()+1)
 		instr_part = fmt.Sprintf("%02X %02X", op_code.code, p1)
 		assem_part = fmt.Sprintf("%s #$%02X", op_code.name, p1)
 	case RELATIVE:
-		p1 := c.MemRead(c.ProgramCounter() + 1)
+		p1 := traceRead(c, c.ProgramCounter()+1)
 		instr_part = fmt.Sprintf("%02X %02X", op_code.code, p1)
 		assem_part = fmt.Sprintf("%s $%02X", op_code.name, addr)
 	case ZEROPAGE:
-		p1 := c.MemRead(c.ProgramCounter() + 1)
-		mem_val := c.MemRead(addr)
+		p1 := traceRead(c, c.ProgramCounter()+1)
+		mem_val := traceRead(c, addr)
 		instr_part = fmt.Sprintf("%02X %02X", op_code.code, p1)
 		assem_part = fmt.Sprintf("%s $%02X = %02X", op_code.name, addr, mem_val)
 	case ZEROPAGEX, ZEROPAGEY:
@@ -41,14 +41,14 @@ func TraceCPU(c *CPU) string {
 		if op_code.mode == ZEROPAGEY {
 			reg = 'Y'
 		}
-		p1 := c.MemRead(c.ProgramCounter() + 1)
-		mem_val := c.MemRead(addr)
+		p1 := traceRead(c, c.ProgramCounter()+1)
+		mem_val := traceRead(c, addr)
 		instr_part = fmt.Sprintf("%02X %02X", op_code.code, p1)
 		assem_part = fmt.Sprintf("%s $%02X,%c @ %02X = %02X", op_code.name, p1, reg, addr, mem_val)
 	case ABSOLUTE:
-		p1 := c.MemRead(c.ProgramCounter() + 1)
-		p2 := c.MemRead(c.ProgramCounter() + 2)
-		mem_val := c.MemRead(addr)
+		p1 := traceRead(c, c.ProgramCounter()+1)
+		p2 := traceRead(c, c.ProgramCounter()+2)
+		mem_val := traceRead(c, addr)
 		instr_part = fmt.Sprintf("%02X %02X %02X", op_code.code, p1, p2)
 		if shouldReturnAddress(op_code.name) {
 			assem_part = fmt.Sprintf("%s $%04X = %02X", op_code.name, addr, mem_val)
@@ -56,45 +56,60 @@ func TraceCPU(c *CPU) string {
 			assem_part = fmt.Sprintf("%s $%04X", op_code.name, addr)
 		}
 	case ABSOLUTEY, ABSOLUTEX:
-		p1 := c.MemRead(c.ProgramCounter() + 1)
-		p2 := c.MemRead(c.ProgramCounter() + 2)
+		p1 := traceRead(c, c.ProgramCounter()+1)
+		p2 := traceRead(c, c.ProgramCounter()+2)
 		reg := 'X'
 		if op_code.mode == ABSOLUTEY {
 			reg = 'Y'
 		}
 		in := make_16_bit(p2, p1)
-		mem_val := c.MemRead(addr)
+		mem_val := traceRead(c, addr)
 		instr_part = fmt.Sprintf("%02X %02X %02X", op_code.code, p1, p2)
 		assem_part = fmt.Sprintf("%s $%04X,%c @ %04X = %02X", op_code.name, in, reg, addr, mem_val)
 	case INDIRECTX:
-		p1 := c.MemRead(c.ProgramCounter() + 1)
+		p1 := traceRead(c, c.ProgramCounter()+1)
 		offset := c.GetRegisterX() + p1
-		mem_val := c.MemRead(addr)
+		mem_val := traceRead(c, addr)
 		instr_part = fmt.Sprintf("%02X %02X", op_code.code, p1)
 		assem_part = fmt.Sprintf("%s ($%02X,X) @ %02X = %04X = %02X", op_code.name, p1, offset, addr, mem_val)
 	case INDIRECTY:
-		p1 := c.MemRead(c.ProgramCounter() + 1)
+		p1 := traceRead(c, c.ProgramCounter()+1)
 		base_ptr := c.mem_read_16_zero(p1)
-		mem_val := c.MemRead(addr)
+		mem_val := traceRead(c, addr)
 		instr_part = fmt.Sprintf("%02X %02X", op_code.code, p1)
 		assem_part = fmt.Sprintf("%s ($%02X),Y = %04X @ %04X = %02X", op_code.name, p1, base_ptr, addr, mem_val)
 	case INDIRECT:
-		p1 := c.MemRead(c.ProgramCounter() + 1)
-		p2 := c.MemRead(c.ProgramCounter() + 2)
+		p1 := traceRead(c, c.ProgramCounter()+1)
+		p2 := traceRead(c, c.ProgramCounter()+2)
 		base_ptr := make_16_bit(p2, p1)
 		instr_part = fmt.Sprintf("%02X %02X %02X", op_code.code, p1, p2)
 		assem_part = fmt.Sprintf("%s ($%04X) = %04X", op_code.name, base_ptr, addr)
 	}
 	instr_str, _ := padSpaces(instr_part, instr_len)
 	assem_str, _ := padSpaces(assem_part, assem_len)
-	ret = fmt.Sprintf("%04X  %s%sA:%02X X:%02X Y:%02X P:%02X SP:%02X CYC:%d",
+	ret = fmt.Sprintf("%04X  %s%sA:%02X X:%02X Y:%02X P:%02X SP:%02X ",
 		c.ProgramCounter(), instr_str, assem_str,
 		c.GetRegisterA(), c.GetRegisterX(), c.GetRegisterY(), c.GetStatus(), c.GetStackPointer(),
-		c.Bus.cycles,
 	)
+	if c.Bus != nil {
+		ret += fmt.Sprintf("PPU:%3d,%3d ", c.Bus.ppu.scanline, c.Bus.ppu.cycles)
+	}
+	ret += fmt.Sprintf("CYC:%d", c.GetCycles())
 	return ret
 }
 
+// Tracing must not disturb the machine, so memory is peeked and registers
+// read as $FF like in the nestest reference log
+func traceRead(c *CPU, addr uint16) uint8 {
+	if c.Bus == nil {
+		return c.MemRead(addr)
+	}
+	if addr >= PPU_REGISTERS && addr < PRG_RAM {
+		return 0xFF
+	}
+	return c.Bus.Peek(addr)
+}
+
 func padSpaces(s string, final_len int) (string, error) {
 	if len(s) > final_len {
 		return s, errors.New("input string is longer than final length")
@@ -2,7 +2,6 @@ package cpu
 
 import (
 	"bufio"
-	"fmt"
 	"os"
 	"strings"
 	"testing"
@@ -13,7 +12,7 @@ func TestTraceAbsoluteInstr(t *testing.T) {
 	c := InitCPU(setupTestBus(vec))
 	c.Reset()
 	actual := TraceCPU(c)
-	expected := "8000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD CYC:0"
+	expected := "8000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD PPU:  0,  0 CYC:0"
 	if !(strings.EqualFold(actual, expected)) {
 		t.Errorf("TraceCPU not returning correct output\nGot:\n%s\nExpected:\n%s", actual, expected)
 	}
@@ -24,7 +23,7 @@ func TestTraceAccumulatorInstr(t *testing.T) {
 	c := InitCPU(setupTestBus(vec))
 	c.Reset()
 	actual := TraceCPU(c)
-	expected := "8000  0A        ASL A                           A:00 X:00 Y:00 P:24 SP:FD CYC:0"
+	expected := "8000  0A        ASL A                           A:00 X:00 Y:00 P:24 SP:FD PPU:  0,  0 CYC:0"
 	if !(strings.EqualFold(actual, expected)) {
 		t.Errorf("TraceCPU not returning correct output\nGot:\n%s\nExpected:\n%s", actual, expected)
 	}
@@ -34,7 +33,7 @@ func TestTraceImmediateInstr(t *testing.T) {
 	c := InitCPU(setupTestBus(vec))
 	c.Reset()
 	actual := TraceCPU(c)
-	expected := "8000  A9 F5     LDA #$F5                        A:00 X:00 Y:00 P:24 SP:FD CYC:0"
+	expected := "8000  A9 F5     LDA #$F5                        A:00 X:00 Y:00 P:24 SP:FD PPU:  0,  0 CYC:0"
 	if !(strings.EqualFold(actual, expected)) {
 		t.Errorf("TraceCPU not returning correct output\nGot:\n%s\nExpected:\n%s", actual, expected)
 	}
@@ -44,7 +43,7 @@ func TestTraceZeroPageInstr(t *testing.T) {
 	c := InitCPU(setupTestBus(vec))
 	c.Reset()
 	actual := TraceCPU(c)
-	expected := "8000  A5 F5     LDA $F5 = 00                    A:00 X:00 Y:00 P:24 SP:FD CYC:0"
+	expected := "8000  A5 F5     LDA $F5 = 00                    A:00 X:00 Y:00 P:24 SP:FD PPU:  0,  0 CYC:0"
 	if !(strings.EqualFold(actual, expected)) {
 		t.Errorf("TraceCPU not returning correct output\nGot:\n%s\nExpected:\n%s", actual, expected)
 	}
@@ -54,7 +53,7 @@ func TestTraceZeroPageXInstr(t *testing.T) {
 	c := InitCPU(setupTestBus(vec))
 	c.Reset()
 	actual := TraceCPU(c)
-	expected := "8000  B5 33     LDA $33,X @ 33 = 00             A:00 X:00 Y:00 P:24 SP:FD CYC:0"
+	expected := "8000  B5 33     LDA $33,X @ 33 = 00             A:00 X:00 Y:00 P:24 SP:FD PPU:  0,  0 CYC:0"
 	if !(strings.EqualFold(actual, expected)) {
 		t.Errorf("TraceCPU not returning correct output\nGot:\n%s\nExpected:\n%s", actual, expected)
 	}
@@ -64,7 +63,7 @@ func TestTraceZeroPageYInstr(t *testing.T) {
 	c := InitCPU(setupTestBus(vec))
 	c.Reset()
 	actual := TraceCPU(c)
-	expected := "8000  B6 33     LDX $33,Y @ 33 = 00             A:00 X:00 Y:00 P:24 SP:FD CYC:0"
+	expected := "8000  B6 33     LDX $33,Y @ 33 = 00             A:00 X:00 Y:00 P:24 SP:FD PPU:  0,  0 CYC:0"
 	if !(strings.EqualFold(actual, expected)) {
 		t.Errorf("TraceCPU not returning correct output\nGot:\n%s\nExpected:\n%s", actual, expected)
 	}
@@ -74,7 +73,7 @@ func TestTraceAbsolutInstr(t *testing.T) {
 	c := InitCPU(setupTestBus(vec))
 	c.Reset()
 	actual := TraceCPU(c)
-	expected := "8000  AD 47 06  LDA $0647 = 00                  A:00 X:00 Y:00 P:24 SP:FD CYC:0"
+	expected := "8000  AD 47 06  LDA $0647 = 00                  A:00 X:00 Y:00 P:24 SP:FD PPU:  0,  0 CYC:0"
 	if !(strings.EqualFold(actual, expected)) {
 		t.Errorf("TraceCPU not returning correct output\nGot:\n%s\nExpected:\n%s", actual, expected)
 	}
@@ -85,7 +84,7 @@ func TestTraceAbsoluteYInstr(t *testing.T) {
 	c := InitCPU(setupTestBus(vec))
 	c.Reset()
 	actual := TraceCPU(c)
-	expected := "8000  B9 00 03  LDA $0300,Y @ 0300 = 00         A:00 X:00 Y:00 P:24 SP:FD CYC:0"
+	expected := "8000  B9 00 03  LDA $0300,Y @ 0300 = 00         A:00 X:00 Y:00 P:24 SP:FD PPU:  0,  0 CYC:0"
 	if !(strings.EqualFold(actual, expected)) {
 		t.Errorf("TraceCPU not returning correct output\nGot:\n%s\nExpected:\n%s", actual, expected)
 	}
@@ -95,7 +94,7 @@ func TestTraceAbsoluteXInstr(t *testing.T) {
 	c := InitCPU(setupTestBus(vec))
 	c.Reset()
 	actual := TraceCPU(c)
-	expected := "8000  BD 00 03  LDA $0300,X @ 0300 = 00         A:00 X:00 Y:00 P:24 SP:FD CYC:0"
+	expected := "8000  BD 00 03  LDA $0300,X @ 0300 = 00         A:00 X:00 Y:00 P:24 SP:FD PPU:  0,  0 CYC:0"
 	if !(strings.EqualFold(actual, expected)) {
 		t.Errorf("TraceCPU not returning correct output\nGot:\n%s\nExpected:\n%s", actual, expected)
 	}
@@ -106,7 +105,7 @@ func TestBasicTraceImpliedInstr(t *testing.T) {
 	c := InitCPU(setupTestBus(vec))
 	c.Reset()
 	actual := TraceCPU(c)
-	expected := "8000  E8        INX                             A:00 X:00 Y:00 P:24 SP:FD CYC:0"
+	expected := "8000  E8        INX                             A:00 X:00 Y:00 P:24 SP:FD PPU:  0,  0 CYC:0"
 	if !(strings.EqualFold(actual, expected)) {
 		t.Errorf("TraceCPU not returning correct output\nGot:\n%s\nExpected:\n%s", actual, expected)
 	}
@@ -117,7 +116,7 @@ func TestBasicTraceRelativeInstr(t *testing.T) {
 	c := InitCPU(setupTestBus(vec))
 	c.Reset()
 	actual := TraceCPU(c)
-	expected := "8000  B0 04     BCS $8006                       A:00 X:00 Y:00 P:24 SP:FD CYC:0"
+	expected := "8000  B0 04     BCS $8006                       A:00 X:00 Y:00 P:24 SP:FD PPU:  0,  0 CYC:0"
 	if !(strings.EqualFold(actual, expected)) {
 		t.Errorf("TraceCPU not returning correct output\nGot:\n%s\nExpected:\n%s", actual, expected)
 	}
@@ -128,7 +127,7 @@ func TestTraceIndirectX(t *testing.T) {
 	c := InitCPU(setupTestBus(vec))
 	c.Reset()
 	actual := TraceCPU(c)
-	expected := "8000  A1 80     LDA ($80,X) @ 80 = 0000 = 00    A:00 X:00 Y:00 P:24 SP:FD CYC:0"
+	expected := "8000  A1 80     LDA ($80,X) @ 80 = 0000 = 00    A:00 X:00 Y:00 P:24 SP:FD PPU:  0,  0 CYC:0"
 	if !(strings.EqualFold(actual, expected)) {
 		t.Errorf("TraceCPU not returning correct output\nGot:\n%s\nExpected:\n%s", actual, expected)
 	}
@@ -139,7 +138,7 @@ func TestTraceIndirectY(t *testing.T) {
 	c := InitCPU(setupTestBus(vec))
 	c.Reset()
 	actual := TraceCPU(c)
-	expected := "8000  B1 89     LDA ($89),Y = 0000 @ 0000 = 00  A:00 X:00 Y:00 P:24 SP:FD CYC:0"
+	expected := "8000  B1 89     LDA ($89),Y = 0000 @ 0000 = 00  A:00 X:00 Y:00 P:24 SP:FD PPU:  0,  0 CYC:0"
 	if !(strings.EqualFold(actual, expected)) {
 		t.Errorf("TraceCPU not returning correct output\nGot:\n%s\nExpected:\n%s", actual, expected)
 	}
@@ -150,7 +149,7 @@ func TestTraceIndirect(t *testing.T) {
 	c := InitCPU(setupTestBus(vec))
 	c.Reset()
 	actual := TraceCPU(c)
-	expected := "8000  6C 00 02  JMP ($0200) = 0000              A:00 X:00 Y:00 P:24 SP:FD CYC:0"
+	expected := "8000  6C 00 02  JMP ($0200) = 0000              A:00 X:00 Y:00 P:24 SP:FD PPU:  0,  0 CYC:0"
 	if !(strings.EqualFold(actual, expected)) {
 		t.Errorf("TraceCPU not returning correct output\nGot:\n%s\nExpected:\n%s", actual, expected)
 	}
@@ -175,29 +174,12 @@ func TestCompareAgainstNesLog(t *testing.T) {
 	r := InitRom(dat)
 	b := InitBus(r, func(*PPU) {})
 	c := InitCPU(b)
-	c.Reset()
-	// Hotfix for now to match reset cycle
-	b.cycles = 7
-	c.program_counter = 0xC000
-	idx := 0
-	c.RunWithCallback(func() {
-		defer func() {
-			if r := recover(); r != nil {
-				fmt.Printf("Panic occurred at log line %d: %v\n", idx, r)
-				panic(r)
-			}
-		}()
+	c.PowerOnAt(RAM_ZEROS, 0, 0xC000)
+	for idx, expected := range answer {
 		actual := TraceCPU(c)
-		expected := formatAns(answer[idx])
 		if !(expected == actual) {
 			t.Fatalf("Log comparison error on line %d\nGot:\n%s\nExpected:\n%s", idx, actual, expected)
 		}
-		idx++
-	})
-
-}
-
-func formatAns(s string) string {
-	cutoff_idx := strings.Index(s, " PPU")
-	return s[:cutoff_idx] + s[cutoff_idx+12:]
+		c.Step(func() {})
+	}
 }
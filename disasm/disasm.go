@@ -0,0 +1,266 @@
+package disasm
+
+import (
+	"fmt"
+	"nesgo/cpu"
+	"sort"
+	"strings"
+)
+
+// Instruction is one decoded instruction, or a single data byte when Valid
+// is false because the byte is not an opcode or the operand is cut off
+type Instruction struct {
+	Addr  uint16
+	Bytes []uint8
+	Op    cpu.OpCode
+	Valid bool
+}
+
+// Options control how a listing is written. Symbols names addresses that are
+// not inside the disassembled range, such as hardware registers
+type Options struct {
+	CA65    bool
+	Symbols map[uint16]string
+}
+
+// NESRegisters can be passed as Options.Symbols to name the PPU and I/O
+// registers
+var NESRegisters = map[uint16]string{
+	0x2000: "PPUCTRL",
+	0x2001: "PPUMASK",
+	0x2002: "PPUSTATUS",
+	0x2003: "OAMADDR",
+	0x2004: "OAMDATA",
+	0x2005: "PPUSCROLL",
+	0x2006: "PPUADDR",
+	0x2007: "PPUDATA",
+	0x4014: "OAMDMA",
+	0x4015: "SND_CHN",
+	0x4016: "JOY1",
+	0x4017: "JOY2",
+}
+
+var vectors = []struct {
+	addr uint16
+	name string
+}{
+	{0xFFFA, "nmi"},
+	{0xFFFC, "reset"},
+	{0xFFFE, "irq"},
+}
+
+// Operand is the little endian value following the opcode
+func (i Instruction) Operand() uint16 {
+	switch len(i.Bytes) {
+	case 2:
+		return uint16(i.Bytes[1])
+	case 3:
+		return uint16(i.Bytes[1]) | uint16(i.Bytes[2])<<8
+	}
+	return 0
+}
+
+// Target returns where a branch, JMP or JSR transfers control to
+func (i Instruction) Target() (uint16, bool) {
+	if !i.Valid {
+		return 0, false
+	}
+	if i.Op.Mode() == cpu.RELATIVE {
+		return i.Addr + 2 + uint16(int8(i.Bytes[1])), true
+	}
+	if (i.Op.Name() == "JMP" || i.Op.Name() == "JSR") && i.Op.Mode() == cpu.ABSOLUTE {
+		return i.Operand(), true
+	}
+	return 0, false
+}
+
+// Bank returns the n-th 16KB PRG bank
+func Bank(prg []uint8, n int) []uint8 {
+	return prg[n*cpu.PRG_ROM_PG_SIZE : (n+1)*cpu.PRG_ROM_PG_SIZE]
+}
+
+// Decode walks data placed at origin linearly and decodes every
+// instruction, nothing outside data is read
+func Decode(data []uint8, origin uint16) []Instruction {
+	var ret []Instruction
+	for pos := 0; pos < len(data); {
+		addr := origin + uint16(pos)
+		op, ok := cpu.OPTABLE[data[pos]]
+		if !ok || pos+int(op.Len()) > len(data) {
+			ret = append(ret, Instruction{Addr: addr, Bytes: data[pos : pos+1]})
+			pos++
+			continue
+		}
+		ret = append(ret, Instruction{Addr: addr, Bytes: data[pos : pos+int(op.Len())], Op: op, Valid: true})
+		pos += int(op.Len())
+	}
+	return ret
+}
+
+// Labels names every branch and jump target and every interrupt vector that
+// lands on the start of a decoded instruction. Vectors are only known when
+// data reaches up to $FFFF
+func Labels(ins []Instruction, data []uint8, origin uint16) map[uint16]string {
+	starts := map[uint16]bool{}
+	for _, i := range ins {
+		starts[i.Addr] = true
+	}
+	labels := map[uint16]string{}
+	for _, i := range ins {
+		target, ok := i.Target()
+		if !ok || !starts[target] || labels[target] != "" {
+			continue
+		}
+		if i.Op.Name() == "JSR" {
+			labels[target] = fmt.Sprintf("S%04X", target)
+		} else {
+			labels[target] = fmt.Sprintf("L%04X", target)
+		}
+	}
+	end := int(origin) + len(data)
+	for _, v := range vectors {
+		pos := int(v.addr) - int(origin)
+		if pos < 0 || int(v.addr)+1 >= end {
+			continue
+		}
+		target := uint16(data[pos]) | uint16(data[pos+1])<<8
+		if starts[target] {
+			labels[target] = v.name
+		}
+	}
+	return labels
+}
+
+// Listing disassembles data placed at origin. The default format shows the
+// address and raw bytes of every line, with CA65 set it is source that ca65
+// assembles back into the same bytes
+func Listing(data []uint8, origin uint16, opts Options) string {
+	ins := Decode(data, origin)
+	labels := Labels(ins, data, origin)
+	names := map[uint16]string{}
+	for addr, name := range opts.Symbols {
+		names[addr] = name
+	}
+	for addr, name := range labels {
+		names[addr] = name
+	}
+	var sb strings.Builder
+	if opts.CA65 {
+		writeCA65Header(&sb, origin, opts.Symbols)
+	}
+	for _, i := range ins {
+		if name, ok := labels[i.Addr]; ok {
+			fmt.Fprintf(&sb, "%s:\n", name)
+		}
+		if opts.CA65 {
+			sb.WriteString(ca65Line(i, names))
+		} else {
+			sb.WriteString(listingLine(i, names))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func writeCA65Header(sb *strings.Builder, origin uint16, symbols map[uint16]string) {
+	sb.WriteString(".setcpu \"6502\"\n")
+	addrs := make([]int, 0, len(symbols))
+	for addr := range symbols {
+		addrs = append(addrs, int(addr))
+	}
+	sort.Ints(addrs)
+	for _, addr := range addrs {
+		fmt.Fprintf(sb, "%s = $%04X\n", symbols[uint16(addr)], addr)
+	}
+	fmt.Fprintf(sb, ".org $%04X\n", origin)
+}
+
+func listingLine(i Instruction, names map[uint16]string) string {
+	raw := make([]string, len(i.Bytes))
+	for idx, b := range i.Bytes {
+		raw[idx] = fmt.Sprintf("%02X", b)
+	}
+	var text string
+	if i.Valid {
+		text = strings.TrimSpace(i.Op.Name() + " " + formatOperand(i, names, false))
+	} else {
+		text = fmt.Sprintf(".byte $%02X", i.Bytes[0])
+	}
+	return fmt.Sprintf("%04X  %-8s  %s", i.Addr, strings.Join(raw, " "), text)
+}
+
+// Unofficial opcodes have several encodings ca65 would not reproduce, so
+// they are written as bytes with the mnemonic as a comment
+func ca65Line(i Instruction, names map[uint16]string) string {
+	if !i.Valid || i.Op.Name()[0] == '*' || i.Op.Name() == "HLT" {
+		raw := make([]string, len(i.Bytes))
+		for idx, b := range i.Bytes {
+			raw[idx] = fmt.Sprintf("$%02X", b)
+		}
+		line := "\t.byte " + strings.Join(raw, ", ")
+		if i.Valid {
+			line += fmt.Sprintf(" ; %s %s", i.Op.Name(), formatOperand(i, names, false))
+		}
+		return strings.TrimRight(line, " ")
+	}
+	return strings.TrimRight("\t"+i.Op.Name()+" "+formatOperand(i, names, true), " ")
+}
+
+func formatOperand(i Instruction, names map[uint16]string, ca65 bool) string {
+	v := i.Operand()
+	byteVal := func() string {
+		return fmt.Sprintf("$%02X", v)
+	}
+	zeroPage := func() string {
+		if name, ok := names[v]; ok {
+			return name
+		}
+		return byteVal()
+	}
+	word := func() string {
+		if name, ok := names[v]; ok {
+			return name
+		}
+		return fmt.Sprintf("$%04X", v)
+	}
+	absolute := func() string {
+		if ca65 && v < 0x100 {
+			// Keep the absolute encoding ca65 would otherwise shorten
+			return "a:" + word()
+		}
+		return word()
+	}
+	switch i.Op.Mode() {
+	case cpu.IMPLIED:
+		return ""
+	case cpu.ACCUMULATOR:
+		return "A"
+	case cpu.IMMEDIATE:
+		return "#" + byteVal()
+	case cpu.ZEROPAGE:
+		return zeroPage()
+	case cpu.ZEROPAGEX:
+		return zeroPage() + ",X"
+	case cpu.ZEROPAGEY:
+		return zeroPage() + ",Y"
+	case cpu.RELATIVE:
+		target, _ := i.Target()
+		if name, ok := names[target]; ok {
+			return name
+		}
+		return fmt.Sprintf("$%04X", target)
+	case cpu.ABSOLUTE:
+		return absolute()
+	case cpu.ABSOLUTEX:
+		return absolute() + ",X"
+	case cpu.ABSOLUTEY:
+		return absolute() + ",Y"
+	case cpu.INDIRECTX:
+		return "(" + zeroPage() + ",X)"
+	case cpu.INDIRECTY:
+		return "(" + zeroPage() + "),Y"
+	case cpu.INDIRECT:
+		return "(" + word() + ")"
+	}
+	return ""
+}
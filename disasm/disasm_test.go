@@ -0,0 +1,124 @@
+package disasm
+
+import (
+	"bytes"
+	"nesgo/asm"
+	"nesgo/cpu"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDecodesInstructions(t *testing.T) {
+	// LDA #$F5, STA $0647, ASL A
+	data := []uint8{0xA9, 0xF5, 0x8D, 0x47, 0x06, 0x0A}
+	ins := Decode(data, 0x8000)
+	if !(len(ins) == 3) {
+		t.Fatalf("Expected 3 instructions, got %d", len(ins))
+	}
+	if !(ins[1].Addr == 0x8002 && ins[1].Op.Name() == "STA" && ins[1].Operand() == 0x0647) {
+		t.Errorf("Wrong second instruction %+v", ins[1])
+	}
+	if !(ins[2].Addr == 0x8005 && ins[2].Op.Mode() == cpu.ACCUMULATOR) {
+		t.Errorf("Wrong third instruction %+v", ins[2])
+	}
+}
+
+func TestDecodesInvalidAndTruncatedAsData(t *testing.T) {
+	// 0x12 is not an opcode and the final LDA is missing its operand bytes
+	data := []uint8{0x12, 0xAD, 0x47}
+	ins := Decode(data, 0x8000)
+	if !(len(ins) == 3 && !ins[0].Valid && !ins[1].Valid && !ins[2].Valid) {
+		t.Errorf("Expected three data bytes, got %+v", ins)
+	}
+}
+
+func TestLabelsBranchAndSubroutineTargets(t *testing.T) {
+	// loop: DEX, BNE loop, JSR sub, BRK, sub: RTS
+	data := []uint8{0xCA, 0xD0, 0xFD, 0x20, 0x07, 0x80, 0x00, 0x60}
+	labels := Labels(Decode(data, 0x8000), data, 0x8000)
+	if !(labels[0x8000] == "L8000" && labels[0x8007] == "S8007" && len(labels) == 2) {
+		t.Errorf("Wrong labels %v", labels)
+	}
+}
+
+func TestLabelsInterruptVectors(t *testing.T) {
+	data := make([]uint8, 0x10)
+	for i := range data {
+		data[i] = 0xEA
+	}
+	// NMI and RESET point into the range, IRQ points outside of it
+	copy(data[0x0A:], []uint8{0xF0, 0xFF, 0xF1, 0xFF, 0x00, 0x80})
+	labels := Labels(Decode(data, 0xFFF0), data, 0xFFF0)
+	if !(labels[0xFFF0] == "nmi" && labels[0xFFF1] == "reset" && len(labels) == 2) {
+		t.Errorf("Wrong vector labels %v", labels)
+	}
+}
+
+func TestListing(t *testing.T) {
+	// loop: LDA PPUSTATUS, BPL loop, LDA $10,X
+	data := []uint8{0xAD, 0x02, 0x20, 0x10, 0xFB, 0xB5, 0x10}
+	actual := Listing(data, 0xC000, Options{Symbols: NESRegisters})
+	expected := strings.Join([]string{
+		"LC000:",
+		"C000  AD 02 20  LDA PPUSTATUS",
+		"C003  10 FB     BPL LC000",
+		"C005  B5 10     LDA $10,X",
+		"",
+	}, "\n")
+	if !(actual == expected) {
+		t.Errorf("Wrong listing\nGot:\n%s\nExpected:\n%s", actual, expected)
+	}
+}
+
+func TestListingCA65(t *testing.T) {
+	// LDA $0010, *NOP, JMP $C000
+	data := []uint8{0xAD, 0x10, 0x00, 0x1A, 0x4C, 0x00, 0xC0}
+	actual := Listing(data, 0xC000, Options{CA65: true})
+	expected := strings.Join([]string{
+		".setcpu \"6502\"",
+		".org $C000",
+		"LC000:",
+		"\tLDA a:$0010",
+		"\t.byte $1A ; *NOP",
+		"\tJMP LC000",
+		"",
+	}, "\n")
+	if !(actual == expected) {
+		t.Errorf("Wrong listing\nGot:\n%s\nExpected:\n%s", actual, expected)
+	}
+}
+
+func TestListingCA65Reassembles(t *testing.T) {
+	// LDA tmp as absolute, zero page, absolute X and Y, zero page X,
+	// (tmp),Y and JMP (tmp)
+	data := []uint8{
+		0xAD, 0x10, 0x00, 0xA5, 0x10, 0xBD, 0x10, 0x00, 0xB9, 0x10, 0x00,
+		0xB5, 0x10, 0xB1, 0x10, 0x6C, 0x10, 0x00,
+	}
+	listing := Listing(data, 0xC000, Options{CA65: true, Symbols: map[uint16]string{0x0010: "tmp"}})
+	for _, line := range []string{"\tLDA a:tmp\n", "\tLDA tmp\n", "\tLDA a:tmp,X\n", "\tLDA (tmp),Y\n"} {
+		if !strings.Contains(listing, line) {
+			t.Errorf("Expected %q in listing\n%s", line, listing)
+		}
+	}
+	p, err := asm.Assemble(listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(p.Origin == 0xC000 && bytes.Equal(p.Code, data)) {
+		t.Errorf("Listing did not reassemble\nGot:      % X\nExpected: % X", p.Code, data)
+	}
+}
+
+func TestListingNestestBank(t *testing.T) {
+	dat, err := os.ReadFile("../nestest.nes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := cpu.InitRom(dat)
+	listing := Listing(Bank(r.GetPRGRom(), 0), 0xC000, Options{})
+	if !strings.Contains(listing, "reset:\nC004  78        SEI") {
+		t.Error("Reset vector not labelled in nestest listing")
+	}
+}
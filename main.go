@@ -1,13 +1,17 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"math"
 	"nesgo/cpu"
+	"nesgo/sound"
 	"os"
 	"time"
 
 	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/audio"
 	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
 	"github.com/hajimehoshi/ebiten/v2/inpututil"
 )
@@ -15,6 +19,12 @@ import (
 const (
 	screenWidth  = 256
 	screenHeight = 240
+	// Audio buffered between the emulator and the player, rate control keeps
+	// it near the target
+	audioBuffer = 200 * time.Millisecond
+	audioTarget = 50 * time.Millisecond
+	// How far ahead the player itself reads
+	playerBuffer = 20 * time.Millisecond
 )
 
 var keyMap map[ebiten.Key]cpu.JoypadButton = map[ebiten.Key]cpu.JoypadButton{
@@ -28,12 +38,35 @@ var keyMap map[ebiten.Key]cpu.JoypadButton = map[ebiten.Key]cpu.JoypadButton{
 	ebiten.KeyS:          cpu.ButtonB,
 }
 
+var ramPatterns map[string]cpu.RamPattern = map[string]cpu.RamPattern{
+	"zeros":    cpu.RAM_ZEROS,
+	"ones":     cpu.RAM_ONES,
+	"random":   cpu.RAM_RANDOM,
+	"hardware": cpu.RAM_HARDWARE,
+}
+
+var regions map[string]cpu.Region = map[string]cpu.Region{
+	"ntsc":  cpu.REGION_NTSC,
+	"pal":   cpu.REGION_PAL,
+	"dendy": cpu.REGION_DENDY,
+}
+
 func handleUserInput(c *cpu.Joypad) {
 	for key, button := range keyMap {
 		c.SetButtonPressedStatus(button, inpututil.KeyPressDuration(key) > 0)
 	}
 }
 
+// F1 presses the reset button, F2 power cycles the console
+func handleResetInput(e *Emulator) {
+	if inpututil.IsKeyJustPressed(ebiten.KeyF1) {
+		e.cpu.SoftReset()
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyF2) {
+		e.cpu.PowerOn(e.ramPattern, e.ramSeed)
+	}
+}
+
 type Emulator struct {
 	cpu         *cpu.CPU
 	texture     *ebiten.Image
@@ -43,11 +76,43 @@ type Emulator struct {
 	lastSecond  time.Time
 	internalFPS float64
 	cpuCycles   uint
+	ramPattern  cpu.RamPattern
+	ramSeed     int64
+	frameRate   float64
+	frameDebt   float64 // emulated frames owed, the console rate is not a whole TPS
+	resampler   *sound.Resampler
+	stream      *sound.Stream
+	player      *audio.Player
+	samples     []float32
 }
 
 func (e *Emulator) Update() error {
+	handleResetInput(e)
 	handleUserInput(e.cpu.Bus.Joypad)
 	prevCycles := e.cpu.GetCycles()
+	// TPS is the console rate rounded, so the debt adds up to an extra frame
+	// about every 10s on NTSC and 140s on PAL. Running two frames in that
+	// tick is a short hitch, accepted to keep emulation at the console's
+	// speed without tying the frame pacing to the audio device
+	e.frameDebt += e.frameRate / float64(ebiten.TPS())
+	for e.frameDebt >= 1 {
+		e.runFrame()
+		e.frameDebt--
+	}
+	e.cpuCycles = e.cpu.GetCycles() - prevCycles
+	e.pushAudio()
+	copyToBuffer(e.frame, e)
+	e.frameCount++
+	now := time.Now()
+	if now.Sub(e.lastSecond) >= time.Second {
+		e.internalFPS = float64(e.frameCount)
+		e.frameCount = 0
+		e.lastSecond = now
+	}
+	return nil
+}
+
+func (e *Emulator) runFrame() {
 	for {
 		alive := e.cpu.Step(func() {})
 
@@ -59,18 +124,40 @@ func (e *Emulator) Update() error {
 			break
 		}
 	}
-	e.cpuCycles = e.cpu.GetCycles() - prevCycles
-	copyToBuffer(e.frame, e)
-	e.frameCount++
-	now := time.Now()
-	if now.Sub(e.lastSecond) >= time.Second {
-		e.internalFPS = float64(e.frameCount)
-		e.frameCount = 0
-		e.lastSecond = now
+}
+
+// startAudio feeds the APU output through the resampler into a player
+// running at sampleRate
+func (e *Emulator) startAudio(bus *cpu.Bus, sampleRate int) error {
+	e.stream = sound.NewStream(durationSamples(audioBuffer, sampleRate), durationSamples(audioTarget, sampleRate))
+	e.samples = make([]float32, durationSamples(audioBuffer, sampleRate))
+	e.resampler = sound.NewResampler(bus.Region().Timing().CPUClockHz, float64(sampleRate), len(e.samples))
+	bus.SetSampleCallback(e.resampler.AddSample)
+	player, err := audio.NewContext(sampleRate).NewPlayerF32(e.stream)
+	if err != nil {
+		return err
 	}
+	player.SetBufferSize(playerBuffer)
+	player.Play()
+	e.player = player
 	return nil
 }
 
+// The host plays samples on its own clock, so the resampling ratio is
+// nudged every frame to keep the buffer from running dry or overflowing
+func (e *Emulator) pushAudio() {
+	if e.stream == nil {
+		return
+	}
+	n := e.resampler.Read(e.samples)
+	e.stream.Write(e.samples[:n])
+	e.resampler.SetRateAdjust(e.stream.RateAdjust())
+}
+
+func durationSamples(d time.Duration, sampleRate int) int {
+	return int(d.Seconds() * float64(sampleRate))
+}
+
 func (e *Emulator) Draw(screen *ebiten.Image) {
 	op := &ebiten.DrawImageOptions{}
 	screen.DrawImage(e.texture, op)
@@ -81,8 +168,8 @@ func (e *Emulator) Layout(outsideWidth, outsideHeight int) (int, int) {
 	return screenWidth, screenHeight
 }
 
-func NewEmulator(c *cpu.CPU, f *cpu.Frame, callTrack *bool) *Emulator {
-	c.Reset()
+func NewEmulator(c *cpu.CPU, f *cpu.Frame, callTrack *bool, pattern cpu.RamPattern, seed int64) *Emulator {
+	c.PowerOn(pattern, seed)
 	texture := ebiten.NewImage(screenWidth, screenHeight)
 	return &Emulator{
 		cpu:        c,
@@ -90,6 +177,8 @@ func NewEmulator(c *cpu.CPU, f *cpu.Frame, callTrack *bool) *Emulator {
 		frame:      f,
 		drawTime:   callTrack,
 		lastSecond: time.Now(),
+		ramPattern: pattern,
+		ramSeed:    seed,
 	}
 }
 
@@ -137,6 +226,22 @@ func copyToBuffer(f *cpu.Frame, e *Emulator) {
 }
 
 func main() {
+	ramFlag := flag.String("ram", "zeros", "power-on RAM pattern: zeros, ones, random or hardware")
+	seedFlag := flag.Int64("seed", time.Now().UnixNano(), "seed for the random RAM pattern")
+	fastFlag := flag.Bool("fast", false, "draw whole frames at once instead of dot by dot")
+	noLimitFlag := flag.Bool("nolimit", false, "draw all sprites of a scanline instead of the first eight, removes flicker")
+	sampleRateFlag := flag.Int("samplerate", 48000, "audio sample rate, usually 44100 or 48000")
+	muteFlag := flag.Bool("mute", false, "run without audio output")
+	regionFlag := flag.String("region", "auto", "console region: auto (from the header), ntsc, pal or dendy")
+	flag.Parse()
+	pattern, ok := ramPatterns[*ramFlag]
+	if !ok {
+		log.Fatalf("Unknown RAM pattern %q", *ramFlag)
+	}
+	region, ok := regions[*regionFlag]
+	if !ok && *regionFlag != "auto" {
+		log.Fatalf("Unknown region %q", *regionFlag)
+	}
 	ebiten.SetWindowSize(screenWidth*10, screenHeight*10)
 	ebiten.SetWindowTitle("NES Emulator")
 	ebiten.SetVsyncEnabled(true)
@@ -144,21 +249,34 @@ func main() {
 	ebiten.SetWindowResizingMode(ebiten.WindowResizingModeEnabled)
 	ebiten.SetWindowFloating(true)
 	ebiten.SetWindowDecorated(true)
-	ebiten.SetTPS(60)
 	dat, err := os.ReadFile("./pacman.nes")
 	if err != nil {
 		panic(err)
 	}
 	var callTrack bool
-	frame := cpu.NewFrame()
 	rom := cpu.InitRom(dat)
 	bus := cpu.InitBus(rom, func(p *cpu.PPU) {
-		frame.Render(p)
 		callTrack = true
 	},
 	)
+	if *fastFlag {
+		bus.SetRenderMode(cpu.RENDER_FRAME)
+	}
+	bus.SetNoSpriteLimit(*noLimitFlag)
+	if *regionFlag != "auto" {
+		bus.SetRegion(region)
+	}
+	frameRate := bus.Region().Timing().FrameRate
+	ebiten.SetTPS(int(math.Round(frameRate)))
+	frame := bus.Frame()
 	cpu := cpu.InitCPU(bus)
-	game := NewEmulator(cpu, frame, &callTrack)
+	game := NewEmulator(cpu, frame, &callTrack, pattern, *seedFlag)
+	game.frameRate = frameRate
+	if !*muteFlag {
+		if err := game.startAudio(bus, *sampleRateFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
 	if err := ebiten.RunGame(game); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,157 @@
+package singlestep
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"nesgo/cpu"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// State is a CPU and RAM snapshot in the community single step test format,
+// RAM lists only the addresses the test cares about as [address, value]
+type State struct {
+	PC  uint16      `json:"pc"`
+	S   uint8       `json:"s"`
+	A   uint8       `json:"a"`
+	X   uint8       `json:"x"`
+	Y   uint8       `json:"y"`
+	P   uint8       `json:"p"`
+	RAM [][2]uint16 `json:"ram"`
+}
+
+// Cycle is one bus access, encoded as [address, value, "read" or "write"]
+type Cycle struct {
+	Addr  uint16
+	Value uint8
+	Kind  string
+}
+
+type Case struct {
+	Name    string  `json:"name"`
+	Initial State   `json:"initial"`
+	Final   State   `json:"final"`
+	Cycles  []Cycle `json:"cycles"`
+}
+
+// B and bit 5 only exist when P is pushed, so they are not compared
+const STATUS_MASK uint8 = 0b1100_1111
+
+func (c *Cycle) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw) != 3 {
+		return fmt.Errorf("cycle should have 3 entries, got %d", len(raw))
+	}
+	if err := json.Unmarshal(raw[0], &c.Addr); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw[1], &c.Value); err != nil {
+		return err
+	}
+	return json.Unmarshal(raw[2], &c.Kind)
+}
+
+// FlatBus is 64KB of RAM with no mirroring or devices, it counts the cycles
+// the CPU ticks and records its accesses
+type FlatBus struct {
+	Data     [0x10000]uint8
+	Cycles   uint
+	Accesses []Cycle
+}
+
+func (b *FlatBus) Read(addr uint16) uint8 {
+	b.Accesses = append(b.Accesses, Cycle{addr, b.Data[addr], "read"})
+	return b.Data[addr]
+}
+
+func (b *FlatBus) Write(addr uint16, v uint8) {
+	b.Accesses = append(b.Accesses, Cycle{addr, v, "write"})
+	b.Data[addr] = v
+}
+
+func (b *FlatBus) Tick(cycles uint8) {
+	b.Cycles += uint(cycles)
+}
+
+func LoadFile(path string) ([]Case, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cases []Case
+	if err := json.Unmarshal(dat, &cases); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cases, nil
+}
+
+// TestFiles lists the JSON test files in dir, sorted by name
+func TestFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	sort.Strings(files)
+	return files, err
+}
+
+// Run executes the single instruction of a test case from its initial state
+// and reports every difference from the final state
+func Run(tc Case, v cpu.Variant) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: cpu panicked: %v", tc.Name, r)
+		}
+	}()
+	bus := &FlatBus{}
+	for _, entry := range tc.Initial.RAM {
+		bus.Data[entry[0]] = uint8(entry[1])
+	}
+	c := cpu.NewCPU(bus, v)
+	c.SetRegisters(cpu.Registers{
+		A:  tc.Initial.A,
+		X:  tc.Initial.X,
+		Y:  tc.Initial.Y,
+		P:  tc.Initial.P,
+		SP: tc.Initial.S,
+		PC: tc.Initial.PC,
+	})
+	c.Step(func() {})
+	return compare(tc, c.Registers(), bus)
+}
+
+func compare(tc Case, r cpu.Registers, bus *FlatBus) error {
+	var diffs []string
+	check := func(name string, got, expected int) {
+		if got != expected {
+			diffs = append(diffs, fmt.Sprintf("%s is $%02X, expected $%02X", name, got, expected))
+		}
+	}
+	check("PC", int(r.PC), int(tc.Final.PC))
+	check("S", int(r.SP), int(tc.Final.S))
+	check("A", int(r.A), int(tc.Final.A))
+	check("X", int(r.X), int(tc.Final.X))
+	check("Y", int(r.Y), int(tc.Final.Y))
+	check("P", int(r.P&STATUS_MASK), int(tc.Final.P&STATUS_MASK))
+	for _, entry := range tc.Final.RAM {
+		check(fmt.Sprintf("RAM[$%04X]", entry[0]), int(bus.Data[entry[0]]), int(entry[1]))
+	}
+	if bus.Cycles != uint(len(tc.Cycles)) {
+		diffs = append(diffs, fmt.Sprintf("took %d cycles, expected %d", bus.Cycles, len(tc.Cycles)))
+	}
+	// The CPU makes no dummy accesses and does not order them by cycle, so
+	// the log is only checked to hold every access it did make
+	for _, a := range bus.Accesses {
+		if !slices.Contains(tc.Cycles, a) {
+			diffs = append(diffs, fmt.Sprintf("unexpected %s of $%02X at $%04X", a.Kind, a.Value, a.Addr))
+		}
+	}
+	if len(diffs) > 0 {
+		return errors.New(tc.Name + ": " + strings.Join(diffs, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package singlestep
+
+import (
+	"embed"
+	"encoding/json"
+	"nesgo/cpu"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testdata holds hand written cases in the single step format for a handful
+// of opcodes, they are not taken from the upstream set and only keep the
+// harness running in CI. Point NESGO_SINGLESTEP_TESTS at a checkout of the
+// NES 6502 set to test every opcode
+const TEST_DIR_ENV = "NESGO_SINGLESTEP_TESTS"
+
+//go:embed testdata/*.json
+var samples embed.FS
+
+func TestEmbeddedSamples(t *testing.T) {
+	files, err := samples.ReadDir("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		dat, err := samples.ReadFile("testdata/" + f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cases []Case
+		if err := json.Unmarshal(dat, &cases); err != nil {
+			t.Fatalf("%s: %v", f.Name(), err)
+		}
+		for _, tc := range cases {
+			if err := Run(tc, cpu.RICOH_2A03); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+func TestReportsDifferences(t *testing.T) {
+	cases, err := LoadFile("testdata/a9.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := cases[0]
+	tc.Final.A = 0x25
+	tc.Cycles = tc.Cycles[:1]
+	err = Run(tc, cpu.RICOH_2A03)
+	expected := "a9 80 00: A is $80, expected $25, took 2 cycles, expected 1, unexpected read of $80 at $1001"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Wrong difference report\nGot:\n%v\nExpected:\n%s", err, expected)
+	}
+}
+
+func TestReportsWrongBusAccess(t *testing.T) {
+	cases, err := LoadFile("testdata/85.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := cases[0]
+	tc.Cycles[2].Addr = 0x11
+	err = Run(tc, cpu.RICOH_2A03)
+	expected := "85 10 00: unexpected write of $42 at $0010"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Wrong difference report\nGot:\n%v\nExpected:\n%s", err, expected)
+	}
+}
+
+func TestUnknownOpcodeIsReported(t *testing.T) {
+	tc := Case{Name: "12", Initial: State{RAM: [][2]uint16{{0, 0x12}}}}
+	if err := Run(tc, cpu.RICOH_2A03); err == nil {
+		t.Error("Expected an error for an opcode the cpu does not know")
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	dir := os.Getenv(TEST_DIR_ENV)
+	if dir == "" {
+		t.Skipf("%s not set", TEST_DIR_ENV)
+	}
+	files, err := TestFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range files {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			cases, err := LoadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			failed := 0
+			for _, tc := range cases {
+				if err := Run(tc, cpu.RICOH_2A03); err != nil {
+					if failed < 5 {
+						t.Error(err)
+					}
+					failed++
+				}
+			}
+			if failed > 0 {
+				t.Errorf("%d of %d cases failed", failed, len(cases))
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package sound
+
+import "math"
+
+// Every level change is drawn as a band-limited step. The steps are built
+// from a windowed sinc with KERNEL_WIDTH taps, precomputed at KERNEL_PHASES
+// sub-sample offsets
+const KERNEL_WIDTH = 16
+const KERNEL_PHASES = 64
+
+// Passband as a fraction of the output Nyquist frequency
+const KERNEL_CUTOFF = 0.9
+
+// The console's output stage blocks DC with a high-pass around 90Hz
+const HIGH_PASS_HZ = 90
+
+var kernel = buildKernel()
+
+// buildKernel samples the sinc impulse for every phase. Each phase sums to
+// 1 so a step always ends at exactly its delta once integrated
+func buildKernel() [KERNEL_PHASES][KERNEL_WIDTH]float32 {
+	var ret [KERNEL_PHASES][KERNEL_WIDTH]float32
+	half := float64(KERNEL_WIDTH) / 2
+	for p := range ret {
+		frac := float64(p) / KERNEL_PHASES
+		var taps [KERNEL_WIDTH]float64
+		sum := 0.0
+		for i := range taps {
+			x := float64(i) - (half - 1) - frac
+			// Blackman window over the kernel width
+			w := 0.42 + 0.5*math.Cos(math.Pi*x/half) + 0.08*math.Cos(2*math.Pi*x/half)
+			if math.Abs(x) >= half {
+				w = 0
+			}
+			taps[i] = sinc(x*KERNEL_CUTOFF) * w
+			sum += taps[i]
+		}
+		for i, t := range taps {
+			ret[p][i] = float32(t / sum)
+		}
+	}
+	return ret
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// Resampler turns a signal clocked at the console's CPU rate into samples
+// at the host rate. Instead of filtering every input clock it only draws
+// the changes of the level, which is all the APU output consists of
+type Resampler struct {
+	clock_rate  float64
+	sample_rate float64
+	step        float64   // output samples per input clock
+	pos         float64   // time of the next input clock in output samples
+	deltas      []float32 // band-limited steps, integrated on read
+	level       float32   // last input level
+	sum         float32   // running integral of deltas
+	hp_in       float32
+	hp_out      float32
+	hp_factor   float32
+}
+
+// NewResampler makes a resampler that buffers up to capacity output
+// samples before it starts dropping the oldest
+func NewResampler(clockRate, sampleRate float64, capacity int) *Resampler {
+	r := &Resampler{
+		clock_rate:  clockRate,
+		sample_rate: sampleRate,
+		deltas:      make([]float32, capacity+KERNEL_WIDTH),
+		hp_factor:   float32(math.Exp(-2 * math.Pi * HIGH_PASS_HZ / sampleRate)),
+	}
+	r.SetRateAdjust(1)
+	return r
+}
+
+// SetRateAdjust scales the number of samples made per input clock. Above 1
+// makes more samples, for when the host plays them faster than they come
+func (r *Resampler) SetRateAdjust(f float64) {
+	r.step = r.sample_rate / r.clock_rate * f
+}
+
+// AddSample takes the input level for one clock
+func (r *Resampler) AddSample(v float32) {
+	if v != r.level {
+		r.addDelta(r.pos, v-r.level)
+		r.level = v
+	}
+	r.pos += r.step
+	// Nobody is reading, keep room for the next step
+	if int(r.pos)+KERNEL_WIDTH > len(r.deltas) {
+		r.consume(nil, int(r.pos)+KERNEL_WIDTH-len(r.deltas))
+	}
+}
+
+func (r *Resampler) addDelta(t float64, delta float32) {
+	i := int(t)
+	phase := &kernel[int((t-float64(i))*KERNEL_PHASES)]
+	for j, k := range phase {
+		r.deltas[i+j] += delta * k
+	}
+}
+
+// Available is the number of finished samples, later input no longer
+// changes them
+func (r *Resampler) Available() int {
+	return int(r.pos)
+}
+
+// Read fills out with finished samples and returns how many it wrote
+func (r *Resampler) Read(out []float32) int {
+	n := min(len(out), r.Available())
+	r.consume(out, n)
+	return n
+}
+
+// consume integrates n samples into out, or drops them when out is nil,
+// and moves the rest of the buffer to the front
+func (r *Resampler) consume(out []float32, n int) {
+	for i := 0; i < n; i++ {
+		r.sum += r.deltas[i]
+		r.hp_out = r.hp_factor * (r.hp_out + r.sum - r.hp_in)
+		r.hp_in = r.sum
+		if out != nil {
+			out[i] = r.hp_out
+		}
+	}
+	copy(r.deltas, r.deltas[n:])
+	clear(r.deltas[len(r.deltas)-n:])
+	r.pos -= float64(n)
+}
@@ -0,0 +1,132 @@
+package sound
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestKernelPhasesSumToOne(t *testing.T) {
+	for p, phase := range kernel {
+		sum := float32(0)
+		for _, k := range phase {
+			sum += k
+		}
+		if !(math.Abs(float64(sum)-1) < 1e-5) {
+			t.Errorf("Phase %d sums to %f", p, sum)
+		}
+	}
+}
+
+func TestResamplerMakesSamplesAtOutputRate(t *testing.T) {
+	r := NewResampler(1789773, 48000, 4096)
+	for i := 0; i < 1789773/100; i++ {
+		r.AddSample(0)
+	}
+	if !(r.Available() == 479 || r.Available() == 480) {
+		t.Errorf("Expected 480 samples for 10ms, got %d", r.Available())
+	}
+	out := make([]float32, 1000)
+	r.Read(out)
+	if !(r.Available() == 0) {
+		t.Error("Read should take every finished sample")
+	}
+}
+
+func TestRateAdjustChangesSampleCount(t *testing.T) {
+	r := NewResampler(1789773, 48000, 8192)
+	r.SetRateAdjust(1.005)
+	for i := 0; i < 1789773/10; i++ {
+		r.AddSample(0)
+	}
+	if !(r.Available() == 4823 || r.Available() == 4824) {
+		t.Errorf("Expected 4824 samples, got %d", r.Available())
+	}
+}
+
+func TestStepSettlesWithoutRinging(t *testing.T) {
+	r := NewResampler(1789773, 48000, 4096)
+	for i := 0; i < 3000; i++ {
+		r.AddSample(0.5)
+	}
+	out := make([]float32, 64)
+	n := r.Read(out)
+	peak := float32(0)
+	for _, v := range out[:n] {
+		peak = max(peak, v)
+	}
+	if !(peak > 0.45 && peak < 0.55) {
+		t.Errorf("Step should rise to 0.5 without much overshoot, peaked at %f", peak)
+	}
+}
+
+func TestHighPassRemovesDC(t *testing.T) {
+	r := NewResampler(1789773, 48000, 4096)
+	out := make([]float32, 4096)
+	for i := 0; i < 1789773; i++ {
+		r.AddSample(0.5)
+		if r.Available() > 2048 {
+			r.Read(out)
+		}
+	}
+	n := r.Read(out)
+	if !(math.Abs(float64(out[n-1])) < 0.001) {
+		t.Errorf("Constant input should decay to 0, got %f", out[n-1])
+	}
+}
+
+func TestResamplerDropsOldestWhenFull(t *testing.T) {
+	r := NewResampler(1789773, 48000, 100)
+	for i := 0; i < 1789773/10; i++ {
+		r.AddSample(float32(i%100) / 100)
+	}
+	if !(r.Available() <= 100) {
+		t.Errorf("Buffer grew past its capacity to %d", r.Available())
+	}
+}
+
+func TestStreamWritesStereoFloats(t *testing.T) {
+	s := NewStream(16, 8)
+	s.Write([]float32{0.25, -0.5})
+	p := make([]byte, 24)
+	n, err := s.Read(p)
+	if err != nil || n != 24 {
+		t.Fatalf("Expected 3 frames, got %d bytes and %v", n, err)
+	}
+	frame := func(i int) (float32, float32) {
+		l := math.Float32frombits(binary.LittleEndian.Uint32(p[i*8:]))
+		r := math.Float32frombits(binary.LittleEndian.Uint32(p[i*8+4:]))
+		return l, r
+	}
+	if l, r := frame(0); !(l == 0.25 && r == 0.25) {
+		t.Error("First frame should carry the first sample on both channels")
+	}
+	if l, _ := frame(2); !(l == -0.5) {
+		t.Error("An underrun should hold the last sample")
+	}
+}
+
+func TestStreamDropsOldestWhenFull(t *testing.T) {
+	s := NewStream(2, 1)
+	s.Write([]float32{1, 2, 3})
+	p := make([]byte, 8)
+	s.Read(p)
+	if !(math.Float32frombits(binary.LittleEndian.Uint32(p)) == 2 && s.Len() == 1) {
+		t.Error("The oldest sample should have been dropped")
+	}
+}
+
+func TestStreamRateAdjustFollowsFill(t *testing.T) {
+	s := NewStream(100, 50)
+	if !(s.RateAdjust() == 1+MAX_RATE_ADJUST) {
+		t.Error("An empty buffer should speed up sample production")
+	}
+	s.Write(make([]float32, 50))
+	if !(s.RateAdjust() == 1) {
+		t.Error("A buffer at its target should resample at the nominal rate")
+	}
+	s.Write(make([]float32, 50))
+	if !(s.RateAdjust() == 1-MAX_RATE_ADJUST) {
+		t.Error("A full buffer should slow down sample production")
+	}
+}
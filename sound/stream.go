@@ -0,0 +1,81 @@
+package sound
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+)
+
+// The resampling ratio is never moved more than this far from nominal,
+// small enough that the pitch change can't be heard
+const MAX_RATE_ADJUST = 0.005
+
+// Stream hands samples from the emulator to the audio player, which reads
+// them on its own goroutine as 32 bit float stereo
+type Stream struct {
+	mu     sync.Mutex
+	buf    []float32 // ring buffer of mono samples
+	start  int
+	size   int
+	last   float32 // repeated when the player catches up with the emulator
+	target int
+}
+
+// NewStream makes a stream holding up to capacity samples, rate control
+// aims to keep it target samples full
+func NewStream(capacity, target int) *Stream {
+	return &Stream{
+		buf:    make([]float32, capacity),
+		target: target,
+	}
+}
+
+// Write queues samples, the oldest are dropped when the buffer is full
+func (s *Stream) Write(samples []float32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range samples {
+		if s.size == len(s.buf) {
+			s.start = (s.start + 1) % len(s.buf)
+			s.size--
+		}
+		s.buf[(s.start+s.size)%len(s.buf)] = v
+		s.size++
+	}
+}
+
+// Len is the number of queued samples
+func (s *Stream) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Read implements io.Reader for the player. It never blocks, when the
+// buffer runs dry the last sample is held instead of dropping to silence,
+// which would click
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	frames := len(p) / 8
+	for i := 0; i < frames; i++ {
+		if s.size > 0 {
+			s.last = s.buf[s.start]
+			s.start = (s.start + 1) % len(s.buf)
+			s.size--
+		}
+		bits := math.Float32bits(s.last)
+		binary.LittleEndian.PutUint32(p[i*8:], bits)
+		binary.LittleEndian.PutUint32(p[i*8+4:], bits)
+	}
+	return frames * 8, nil
+}
+
+// RateAdjust is the factor to resample with so the buffer drifts back to
+// its target fill, it moves linearly with the distance from the target
+func (s *Stream) RateAdjust() float64 {
+	fill := float64(s.Len())
+	target := float64(s.target)
+	d := max(-1, min(1, (target-fill)/target))
+	return 1 + d*MAX_RATE_ADJUST
+}
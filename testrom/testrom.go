@@ -0,0 +1,114 @@
+package testrom
+
+import (
+	"errors"
+	"fmt"
+	"nesgo/cpu"
+	"os"
+	"time"
+)
+
+// Test ROMs by blargg and others report through cartridge RAM at $6000. The
+// signature at $6001 marks the status byte at $6000 as valid, and $6004
+// holds a NUL terminated message
+const STATUS_ADDR uint16 = 0x6000
+const SIGNATURE_ADDR uint16 = 0x6001
+const TEXT_ADDR uint16 = 0x6004
+
+const STATUS_RUNNING uint8 = 0x80
+const STATUS_NEEDS_RESET uint8 = 0x81
+
+var SIGNATURE = [3]uint8{0xDE, 0xB0, 0x61}
+
+// The ROM asks for a reset and expects it to come at least this late
+const RESET_DELAY = 100 * time.Millisecond
+
+var ErrTimeout = errors.New("test rom did not finish before the timeout")
+
+type Result struct {
+	Status  uint8
+	Message string
+}
+
+func (r *Result) Passed() bool {
+	return r.Status == 0
+}
+
+// RunFile loads and runs the test ROM at path, see Run
+func RunFile(path string, timeout time.Duration) (*Result, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Run(dat, timeout)
+}
+
+// Run executes a test ROM headless until it reports a final status or the
+// timeout, measured in emulated time, runs out
+func Run(dat []uint8, timeout time.Duration) (res *Result, err error) {
+	// A crashing ROM is a failed test, not a reason to take the caller down
+	defer func() {
+		if r := recover(); r != nil {
+			res = nil
+			err = fmt.Errorf("test rom crashed: %v", r)
+		}
+	}()
+	rom := cpu.InitRom(dat)
+	if rom.GetMapper() != 0 {
+		return nil, fmt.Errorf("mapper %d is not supported", rom.GetMapper())
+	}
+	bus := cpu.InitBus(rom, func(*cpu.PPU) {})
+	c := cpu.InitCPU(bus)
+	c.PowerOn(cpu.RAM_ZEROS, 0)
+	// The header picks the region, which sets how long a second is
+	timing := bus.Region().Timing()
+	maxCycles := toCycles(timeout, timing)
+	var resetAt uint
+	for c.GetCycles() < maxCycles {
+		c.Step(func() {})
+		if !hasSignature(bus) {
+			continue
+		}
+		switch status := bus.Peek(STATUS_ADDR); status {
+		case STATUS_RUNNING:
+		case STATUS_NEEDS_RESET:
+			if resetAt == 0 {
+				resetAt = c.GetCycles() + toCycles(RESET_DELAY, timing)
+			} else if c.GetCycles() >= resetAt {
+				resetAt = 0
+				c.SoftReset()
+			}
+		default:
+			return &Result{Status: status, Message: readText(bus)}, nil
+		}
+	}
+	if hasSignature(bus) {
+		return &Result{Status: bus.Peek(STATUS_ADDR), Message: readText(bus)}, ErrTimeout
+	}
+	return nil, ErrTimeout
+}
+
+func toCycles(d time.Duration, timing cpu.Timing) uint {
+	return uint(d.Seconds() * timing.CPUClockHz)
+}
+
+func hasSignature(b *cpu.Bus) bool {
+	for i, v := range SIGNATURE {
+		if b.Peek(SIGNATURE_ADDR+uint16(i)) != v {
+			return false
+		}
+	}
+	return true
+}
+
+func readText(b *cpu.Bus) string {
+	var text []byte
+	for addr := TEXT_ADDR; addr <= cpu.PRG_RAM_END; addr++ {
+		v := b.Peek(addr)
+		if v == 0 {
+			break
+		}
+		text = append(text, v)
+	}
+	return string(text)
+}
@@ -0,0 +1,482 @@
+package testrom
+
+import (
+	"nesgo/asm"
+	"nesgo/cpu"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Set NESGO_TEST_ROMS to a directory of test ROMs to run them all
+const TEST_ROM_DIR_ENV = "NESGO_TEST_ROMS"
+
+// buildRom wraps the program in an NROM image with the reset vector
+// pointing at its first byte
+func buildRom(t *testing.T, src string) []uint8 {
+	return assembleRom(t, ".org $C000\nreset:\n"+src+"\n.org $FFFA\n.word reset, reset, reset\n")
+}
+
+// buildIRQRom is buildRom for programs with an irq label to handle IRQs
+func buildIRQRom(t *testing.T, src string) []uint8 {
+	return assembleRom(t, ".org $C000\nreset:\n"+src+"\n.org $FFFA\n.word reset, reset, irq\n")
+}
+
+func assembleRom(t *testing.T, src string) []uint8 {
+	p, err := asm.Assemble(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []uint8{0x4e, 0x45, 0x53, 0x1a, 0x01, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	dat := make([]uint8, 16+0x4000+0x2000)
+	copy(dat, header)
+	copy(dat[16:], p.Code)
+	return dat
+}
+
+// Status is set to running before the signature makes it valid
+const writeSignature = `
+	LDA #$80
+	STA $6000
+	LDA #$DE
+	STA $6001
+	LDA #$B0
+	STA $6002
+	LDA #$61
+	STA $6003
+`
+
+func TestReportsPass(t *testing.T) {
+	dat := buildRom(t, writeSignature+`
+		LDA #'o'
+		STA $6004
+		LDA #'k'
+		STA $6005
+		LDA #$00
+		STA $6006
+		STA $6000
+	hang:
+		JMP hang
+	`)
+	res, err := Run(dat, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(res.Passed() && res.Message == "ok") {
+		t.Errorf("Expected pass with message ok, got %+v", res)
+	}
+}
+
+func TestReportsFailure(t *testing.T) {
+	dat := buildRom(t, writeSignature+`
+		LDA #$00
+		STA $6004
+		LDA #$03
+		STA $6000
+	hang:
+		JMP hang
+	`)
+	res, err := Run(dat, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(!res.Passed() && res.Status == 3) {
+		t.Errorf("Expected failure code 3, got %+v", res)
+	}
+}
+
+func TestResetsWhenAsked(t *testing.T) {
+	// Passes only when it runs a second time after a reset
+	dat := buildRom(t, writeSignature+`
+		LDA $6010
+		BNE second
+		LDA #$01
+		STA $6010
+		LDA #$81
+		STA $6000
+	wait:
+		JMP wait
+	second:
+		LDA #$00
+		STA $6004
+		STA $6000
+	hang:
+		JMP hang
+	`)
+	res, err := Run(dat, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Passed() {
+		t.Errorf("Expected pass after reset, got %+v", res)
+	}
+}
+
+func TestTimesOut(t *testing.T) {
+	dat := buildRom(t, writeSignature+`
+	hang:
+		JMP hang
+	`)
+	res, err := Run(dat, 10*time.Millisecond)
+	if !(err == ErrTimeout && res != nil && res.Status == STATUS_RUNNING) {
+		t.Errorf("Expected timeout while running, got %+v %v", res, err)
+	}
+}
+
+func TestTimeoutFollowsRegionClock(t *testing.T) {
+	if !(toCycles(time.Second, cpu.REGION_PAL.Timing()) == 1662607 && toCycles(time.Second, cpu.REGION_NTSC.Timing()) == 1789773) {
+		t.Error("A second of emulated time should be the region's CPU clock")
+	}
+}
+
+func TestCrashIsReported(t *testing.T) {
+	// 0x12 is not an opcode the CPU knows
+	dat := buildRom(t, ".byte $12")
+	if _, err := Run(dat, time.Second); err == nil {
+		t.Error("Expected an error for a crashing rom")
+	}
+}
+
+func TestFrameIRQIsTakenAndAcknowledged(t *testing.T) {
+	dat := buildIRQRom(t, writeSignature+`
+		LDA #$00
+		STA $4017
+		CLI
+	wait:
+		LDA $10
+		BEQ wait
+		LDA $4015
+		AND #$40
+		BNE fail
+		LDA $11
+		AND #$40
+		BEQ fail
+		LDA #$00
+		STA $6004
+		STA $6000
+	hang:
+		JMP hang
+	fail:
+		LDA #$00
+		STA $6004
+		LDA #$02
+		STA $6000
+		JMP hang
+	irq:
+		LDA $4015
+		STA $11
+		INC $10
+		RTI
+	`)
+	res, err := Run(dat, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Passed() {
+		t.Errorf("Expected the frame IRQ to be taken once, got %+v", res)
+	}
+}
+
+func TestInhibitedFrameCounterDoesNotInterrupt(t *testing.T) {
+	// Waits about three four step sequences with IRQs enabled
+	dat := buildIRQRom(t, writeSignature+`
+		LDA #$40
+		STA $4017
+		CLI
+		LDY #$00
+		LDX #$00
+	wait:
+		DEX
+		BNE wait
+		INY
+		CPY #$40
+		BNE wait
+		LDA #$00
+		STA $6004
+		STA $6000
+	hang:
+		JMP hang
+	irq:
+		LDA #$00
+		STA $6004
+		LDA #$02
+		STA $6000
+		JMP hang
+	`)
+	res, err := Run(dat, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Passed() {
+		t.Errorf("Expected no frame IRQ, got %+v", res)
+	}
+}
+
+// The tests below are hand written programs modelled on some of the checks
+// in blargg's apu_test ROMs, they are approximations and not the ROMs
+// themselves. They report the number of the failing check, X holds it on a
+// jump to fail
+const reportResult = `
+	fail:
+		TXA
+		JMP report
+	pass:
+		LDA #$00
+	report:
+		LDY #$00
+		STY $6004
+		STA $6000
+	hang:
+		JMP hang
+`
+
+// Checks pulse 1's length counter through $4015, X is the check number
+const lengthStatus = `
+	length_on:
+		LDA $4015
+		AND #$01
+		BEQ fail
+		RTS
+	length_off:
+		LDA $4015
+		AND #$01
+		BNE fail
+		RTS
+`
+
+// Checks the frame IRQ flag through $4015, which acknowledges it
+const frameIRQStatus = `
+	flag_on:
+		LDA $4015
+		AND #$40
+		BEQ fail
+		RTS
+	flag_off:
+		LDA $4015
+		AND #$40
+		BNE fail
+		RTS
+	; About 32000 cycles, more than one four step sequence
+	delay:
+		LDA #$19
+		STA $10
+	delay_outer:
+		LDY #$00
+	delay_inner:
+		DEY
+		BNE delay_inner
+		DEC $10
+		BNE delay_outer
+		RTS
+`
+
+func runApuTestRom(t *testing.T, src string) {
+	res, err := Run(buildRom(t, writeSignature+src+reportResult), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Passed() {
+		t.Errorf("Check %d failed", res.Status)
+	}
+}
+
+// Modelled on 1-len_ctr
+func TestLengthCounterRom(t *testing.T) {
+	runApuTestRom(t, `
+		LDA #$01
+		STA $4015
+		; Length index 3 loads 2
+		LDX #$02
+		LDA #$18
+		STA $4003
+		JSR length_on
+		; Writing $80 to $4017 clocks the length right away
+		LDX #$04
+		LDA #$80
+		STA $4017
+		JSR length_on
+		LDA #$80
+		STA $4017
+		JSR length_off
+		; Writing $00 does not
+		LDX #$05
+		LDA #$18
+		STA $4003
+		LDA #$00
+		STA $4017
+		STA $4017
+		LDA #$80
+		STA $4017
+		JSR length_on
+		; Disabling the channel clears the length
+		LDX #$06
+		LDA #$00
+		STA $4015
+		JSR length_off
+		; A disabled channel ignores length loads
+		LDX #$07
+		LDA #$18
+		STA $4003
+		JSR length_off
+		; The halt bit stops length clocking
+		LDX #$08
+		LDA #$01
+		STA $4015
+		LDA #$20
+		STA $4000
+		LDA #$18
+		STA $4003
+		LDA #$80
+		STA $4017
+		STA $4017
+		STA $4017
+		JSR length_on
+		JMP pass
+	`+lengthStatus)
+}
+
+// Modelled on 2-len_table, every length index counted down with $80 writes
+// to $4017
+func TestLengthTableRom(t *testing.T) {
+	runApuTestRom(t, `
+		LDA #$01
+		STA $4015
+		LDY #$00
+	next:
+		TYA
+		ASL
+		ASL
+		ASL
+		STA $4003
+		LDX #$00
+	count:
+		LDA $4015
+		AND #$01
+		BEQ counted
+		LDA #$80
+		STA $4017
+		INX
+		BNE count
+		LDX #$02
+		JMP fail
+	counted:
+		TXA
+		CMP table,Y
+		BEQ matches
+		LDX #$02
+		JMP fail
+	matches:
+		INY
+		CPY #$20
+		BNE next
+		JMP pass
+	table:
+		.byte 10, 254, 20, 2, 40, 4, 80, 6, 160, 8, 60, 10, 14, 12, 26, 14
+		.byte 12, 16, 24, 18, 48, 20, 96, 22, 192, 24, 72, 26, 16, 28, 32, 30
+	`)
+}
+
+// Modelled on 3-irq_flag
+func TestFrameIRQFlagRom(t *testing.T) {
+	runApuTestRom(t, `
+		LDX #$02
+		LDA #$40
+		STA $4017
+		JSR delay
+		JSR flag_off
+		LDX #$03
+		LDA #$80
+		STA $4017
+		JSR delay
+		JSR flag_off
+		LDX #$04
+		LDA #$00
+		STA $4017
+		JSR delay
+		JSR flag_on
+		; flag_on read the flag, which acknowledged it
+		LDX #$05
+		JSR flag_off
+		; Writing $00 or $80 leaves the flag alone
+		LDX #$06
+		LDA #$00
+		STA $4017
+		JSR delay
+		LDA #$00
+		STA $4017
+		LDA #$80
+		STA $4017
+		JSR flag_on
+		; Writing $40 or $C0 clears it
+		LDX #$07
+		LDA #$00
+		STA $4017
+		JSR delay
+		LDA #$40
+		STA $4017
+		JSR flag_off
+		LDA #$00
+		STA $4017
+		JSR delay
+		LDA #$C0
+		STA $4017
+		JSR flag_off
+		JMP pass
+	`+frameIRQStatus)
+}
+
+// Modelled on 6-irq_flag_timing. The flag is set 29831 cycles after the
+// write, the $4015 read of pass n lands 8+13n cycles after it plus 4 for
+// every wrap of X, so pass 2292 is the first to see it
+func TestFrameIRQFlagTimingRom(t *testing.T) {
+	runApuTestRom(t, `
+		LDA #$00
+		STA $4017
+		LDX #$00
+		LDY #$00
+	poll:
+		LDA $4015
+		AND #$40
+		BNE found
+		INX
+		BNE poll
+		INY
+		JMP poll
+	found:
+		STX $10
+		LDX #$02
+		CPY #$08
+		BNE fail
+		LDA $10
+		CMP #$F4
+		BNE fail
+		JMP pass
+	`)
+}
+
+func TestRomDirectory(t *testing.T) {
+	dir := os.Getenv(TEST_ROM_DIR_ENV)
+	if dir == "" {
+		t.Skipf("%s not set", TEST_ROM_DIR_ENV)
+	}
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(strings.ToLower(path), ".nes") {
+			return err
+		}
+		t.Run(strings.TrimPrefix(path, dir), func(t *testing.T) {
+			res, err := RunFile(path, 60*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !res.Passed() {
+				t.Errorf("Status %d: %s", res.Status, res.Message)
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}